@@ -0,0 +1,1295 @@
+package gotcha
+
+/*
+  This file implements the Store interface on top of BoltDB
+
+  All projects, queues and messages are persisted in a single local file.
+  Each operation runs in its own BoltDB transaction so that the file is
+  never left in an inconsistent state should the process crash.
+
+  Usage:
+    StartBolt("/var/lib/gotcha/gotcha.db")
+    ...
+    Storage.Close()
+
+  Layout:
+    project:       project id -> BSON encoded project
+    queue:         queue id -> BSON encoded queue
+    topic:         topic id -> BSON encoded topic
+    subscription:  subscription id -> BSON encoded subscription
+    subscriber:    subscriber id -> BSON encoded subscriber
+    token:         token id -> BSON encoded token
+    message:       one nested bucket per queue id, message id -> BSON encoded message
+    message_queue: message id -> queue id (used to load messages by id)
+    deduplication: one nested bucket per queue id, deduplication id -> BSON encoded record
+    message_index: one nested bucket per queue id holding the message indexes
+                   below, all mapping keys to message ids
+      ready:   lease order key -> id of messages neither leased nor delayed
+      waiting: lease expiry (or visibility) time + id -> id of leased or delayed messages
+      expiry:  expiry time + id -> id of all messages
+      group:   group id + creation time + id -> id of messages in a group
+
+  Indexes let leasing, dead-lettering and purging walk the few messages they
+  need with a cursor instead of decoding the whole queue. Leased and delayed
+  messages are moved from the waiting index to the ready index once their
+  lease expires or they become visible, see boltIndex.promote.
+*/
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "github.com/boltdb/bolt"
+  "labix.org/v2/mgo/bson"
+  "log"
+  "time"
+)
+
+// Names of top level buckets
+var (
+  projectBucket      = []byte("project")
+  queueBucket        = []byte("queue")
+  topicBucket        = []byte("topic")
+  subscriptionBucket = []byte("subscription")
+  subscriberBucket   = []byte("subscriber")
+  tokenBucket        = []byte("token")
+  messageBucket      = []byte("message")
+  messageQueueBucket = []byte("message_queue")
+  dedupBucket        = []byte("deduplication")
+  messageIndexBucket = []byte("message_index")
+)
+
+// Names of index buckets nested in the message_index bucket of each queue
+var (
+  readyIndex   = []byte("ready")
+  waitingIndex = []byte("waiting")
+  expiryIndex  = []byte("expiry")
+  groupIndex   = []byte("group")
+)
+
+// First byte of ready index keys, messages leased MaxAttempts times come last
+// so that leasing never walks them
+const (
+  boltLeasable byte = 0
+  boltPoisoned byte = 1
+)
+
+// BoltDB backed storage
+type boltStore struct {
+  db *bolt.DB
+}
+
+// Open (or create) database file at given path and use it as storage
+func StartBolt(path string) error {
+  db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Duration(1) * time.Second})
+  if err != nil {
+    log.Printf("**ERROR: Could not open BoltDB file '%v': %v", path, err)
+    return err
+  }
+
+  // Create top level buckets if needed
+  err = db.Update(func(tx *bolt.Tx) error {
+    for _, name := range [][]byte{projectBucket, queueBucket, topicBucket, subscriptionBucket, subscriberBucket, tokenBucket,
+      messageBucket, messageQueueBucket, dedupBucket, messageIndexBucket} {
+      if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    log.Printf("**ERROR: Could not initialize BoltDB file '%v': %v", path, err)
+    db.Close()
+    return err
+  }
+
+  Storage = &boltStore{db: db}
+  return nil
+}
+
+// Close database file
+func (s *boltStore) Close() {
+  s.db.Close()
+}
+
+// List all projects
+func (s *boltStore) ListProjects() (*[]Project, error) {
+  ps := make([]Project, 0, 10)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    return tx.Bucket(projectBucket).ForEach(func(k, v []byte) error {
+      var p Project
+      if err := boltUnmarshal(v, &p); err != nil {
+        return err
+      }
+      ps = append(ps, p)
+      return nil
+    })
+  })
+  return &ps, err
+}
+
+// Save new project, names must be unique
+func (s *boltStore) InsertProject(p *Project) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindProject(tx, p.Name); err != nil {
+      return err
+    } else if existing != nil {
+      return errors.New(fmt.Sprintf("Project '%v' already exists", p.Name))
+    }
+    return boltPut(tx.Bucket(projectBucket), p.ID, p)
+  })
+}
+
+// Load project with given name
+func (s *boltStore) LoadProject(name string) (*Project, error) {
+  var p *Project
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    p, err = boltFindProject(tx, name)
+    return err
+  })
+  if err == nil && p == nil {
+    err = ErrNotFound
+  }
+  return p, err
+}
+
+// Load project with given id
+func (s *boltStore) LoadProjectId(id bson.ObjectId) (*Project, error) {
+  p := new(Project)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    return boltGet(tx.Bucket(projectBucket), id, p)
+  })
+  return p, err
+}
+
+// Delete project
+func (s *boltStore) DestroyProject(p *Project) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return boltDelete(tx.Bucket(projectBucket), p.ID)
+  })
+}
+
+// List all queues in project
+func (s *boltStore) ListQueues(p *Project) (*[]Queue, error) {
+  qs := make([]Queue, 0)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    return tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+      var q Queue
+      if err := boltUnmarshal(v, &q); err != nil {
+        return err
+      }
+      if q.ProjectID == p.ID {
+        qs = append(qs, q)
+      }
+      return nil
+    })
+  })
+  return &qs, err
+}
+
+// Number of queues in project
+func (s *boltStore) CountQueues(p *Project) (int, error) {
+  qs, err := s.ListQueues(p)
+  if err != nil {
+    return 0, err
+  }
+  return len(*qs), nil
+}
+
+// Save new queue, names must be unique in project
+func (s *boltStore) InsertQueue(q *Queue) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindQueue(tx, q.ProjectID, q.Name); err != nil {
+      return err
+    } else if existing != nil {
+      return errors.New(fmt.Sprintf("Queue '%v' already exists", q.Name))
+    }
+    if _, err := tx.Bucket(messageBucket).CreateBucketIfNotExists([]byte(q.ID)); err != nil {
+      return err
+    }
+    return boltPut(tx.Bucket(queueBucket), q.ID, q)
+  })
+}
+
+// Load queue with given name from project
+func (s *boltStore) LoadQueue(p *Project, name string) (*Queue, error) {
+  var q *Queue
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    q, err = boltFindQueue(tx, p.ID, name)
+    return err
+  })
+  if err == nil && q == nil {
+    err = ErrNotFound
+  }
+  return q, err
+}
+
+// Load queue with given id
+func (s *boltStore) LoadQueueId(id bson.ObjectId) (*Queue, error) {
+  q := new(Queue)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    return boltGet(tx.Bucket(queueBucket), id, q)
+  })
+  return q, err
+}
+
+// Delete queue and its message bucket
+func (s *boltStore) DestroyQueue(q *Queue) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if err := boltClearMessages(tx, q.ID); err != nil {
+      return err
+    }
+    if err := tx.Bucket(messageBucket).DeleteBucket([]byte(q.ID)); err != nil && err != bolt.ErrBucketNotFound {
+      return err
+    }
+    return boltDelete(tx.Bucket(queueBucket), q.ID)
+  })
+}
+
+// List all topics in project
+func (s *boltStore) ListTopics(p *Project) (*[]Topic, error) {
+  ts := make([]Topic, 0)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    return tx.Bucket(topicBucket).ForEach(func(k, v []byte) error {
+      var t Topic
+      if err := boltUnmarshal(v, &t); err != nil {
+        return err
+      }
+      if t.ProjectID == p.ID {
+        ts = append(ts, t)
+      }
+      return nil
+    })
+  })
+  return &ts, err
+}
+
+// Save new topic, names must be unique in project
+func (s *boltStore) InsertTopic(t *Topic) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindTopic(tx, t.ProjectID, t.Name); err != nil {
+      return err
+    } else if existing != nil {
+      return errors.New(fmt.Sprintf("Topic '%v' already exists", t.Name))
+    }
+    return boltPut(tx.Bucket(topicBucket), t.ID, t)
+  })
+}
+
+// Load topic with given name from project
+func (s *boltStore) LoadTopic(p *Project, name string) (*Topic, error) {
+  var t *Topic
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    t, err = boltFindTopic(tx, p.ID, name)
+    return err
+  })
+  if err == nil && t == nil {
+    err = ErrNotFound
+  }
+  return t, err
+}
+
+// Delete topic
+func (s *boltStore) DestroyTopic(t *Topic) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return boltDelete(tx.Bucket(topicBucket), t.ID)
+  })
+}
+
+// List all subscriptions of topic
+func (s *boltStore) ListSubscriptions(t *Topic) (*[]Subscription, error) {
+  var subs []Subscription
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    subs, err = boltFindSubscriptions(tx, t.ID, "")
+    return err
+  })
+  return &subs, err
+}
+
+// Save new subscription, at most one per topic and queue
+func (s *boltStore) InsertSubscription(sub *Subscription) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindSubscriptions(tx, sub.TopicID, sub.QueueID); err != nil {
+      return err
+    } else if len(existing) > 0 {
+      return errors.New("Queue is already subscribed to topic")
+    }
+    return boltPut(tx.Bucket(subscriptionBucket), sub.ID, sub)
+  })
+}
+
+// Load subscription of given queue to topic
+func (s *boltStore) LoadSubscription(t *Topic, q *Queue) (*Subscription, error) {
+  var subs []Subscription
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    subs, err = boltFindSubscriptions(tx, t.ID, q.ID)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+  if len(subs) == 0 {
+    return nil, ErrNotFound
+  }
+  return &subs[0], nil
+}
+
+// Delete subscription
+func (s *boltStore) DestroySubscription(sub *Subscription) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return boltDelete(tx.Bucket(subscriptionBucket), sub.ID)
+  })
+}
+
+// List all subscribers of queue
+func (s *boltStore) ListSubscribers(q *Queue) (*[]Subscriber, error) {
+  var subs []Subscriber
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    subs, err = boltFindSubscribers(tx, q.ID, "")
+    return err
+  })
+  return &subs, err
+}
+
+// Save new subscriber, names must be unique in queue
+func (s *boltStore) InsertSubscriber(sub *Subscriber) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindSubscribers(tx, sub.QueueID, sub.Name); err != nil {
+      return err
+    } else if len(existing) > 0 {
+      return errors.New(fmt.Sprintf("Subscriber '%v' already exists", sub.Name))
+    }
+    return boltPut(tx.Bucket(subscriberBucket), sub.ID, sub)
+  })
+}
+
+// Load subscriber with given name from queue
+func (s *boltStore) LoadSubscriber(q *Queue, name string) (*Subscriber, error) {
+  var subs []Subscriber
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    subs, err = boltFindSubscribers(tx, q.ID, name)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+  if len(subs) == 0 {
+    return nil, ErrNotFound
+  }
+  return &subs[0], nil
+}
+
+// Delete subscriber
+func (s *boltStore) DestroySubscriber(sub *Subscriber) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return boltDelete(tx.Bucket(subscriberBucket), sub.ID)
+  })
+}
+
+// List all tokens of project
+func (s *boltStore) ListTokens(p *Project) (*[]Token, error) {
+  var ts []Token
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    ts, err = boltFindTokens(tx, func(t *Token) bool { return t.ProjectID == p.ID })
+    return err
+  })
+  return &ts, err
+}
+
+// Save new token, names must be unique in project
+func (s *boltStore) InsertToken(t *Token) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    if existing, err := boltFindTokens(tx, func(o *Token) bool { return o.ProjectID == t.ProjectID && o.Name == t.Name }); err != nil {
+      return err
+    } else if len(existing) > 0 {
+      return errors.New(fmt.Sprintf("Token '%v' already exists", t.Name))
+    }
+    return boltPut(tx.Bucket(tokenBucket), t.ID, t)
+  })
+}
+
+// Load token with given name from project
+func (s *boltStore) LoadToken(p *Project, name string) (*Token, error) {
+  return s.loadToken(func(t *Token) bool { return t.ProjectID == p.ID && t.Name == name })
+}
+
+// Load token with given secret hash
+func (s *boltStore) LoadTokenHash(hash string) (*Token, error) {
+  return s.loadToken(func(t *Token) bool { return t.Hash == hash })
+}
+
+// Load first token for which match returns true, return ErrNotFound if none does
+func (s *boltStore) loadToken(match func(t *Token) bool) (*Token, error) {
+  var ts []Token
+  err := s.db.View(func(tx *bolt.Tx) error {
+    var err error
+    ts, err = boltFindTokens(tx, match)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+  if len(ts) == 0 {
+    return nil, ErrNotFound
+  }
+  return &ts[0], nil
+}
+
+// Delete token
+func (s *boltStore) DestroyToken(t *Token) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return boltDelete(tx.Bucket(tokenBucket), t.ID)
+  })
+}
+
+// Save new messages, all messages are saved or none
+func (s *boltStore) InsertMessages(messages *[]*Message) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    indexes := make(map[bson.ObjectId]*boltIndex)
+    for _, m := range *messages {
+      b := tx.Bucket(messageBucket).Bucket([]byte(m.QueueID))
+      if b == nil {
+        return errors.New(fmt.Sprintf("Queue with id %v does not exist", m.QueueID.Hex()))
+      }
+      x, ok := indexes[m.QueueID]
+      if !ok {
+        q := new(Queue)
+        if err := boltGet(tx.Bucket(queueBucket), m.QueueID, q); err != nil {
+          return err
+        }
+        var err error
+        if x, err = boltOpenIndex(tx, q); err != nil {
+          return err
+        }
+        indexes[m.QueueID] = x
+      }
+      if err := boltPut(b, m.ID, m); err != nil {
+        return err
+      }
+      if err := x.add(m); err != nil {
+        return err
+      }
+      if err := tx.Bucket(messageQueueBucket).Put([]byte(m.ID), []byte(m.QueueID)); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+// Load message with given id
+func (s *boltStore) LoadMessage(id bson.ObjectId) (*Message, error) {
+  m := new(Message)
+  err := s.db.View(func(tx *bolt.Tx) error {
+    qid := tx.Bucket(messageQueueBucket).Get([]byte(id))
+    if qid == nil {
+      return ErrNotFound
+    }
+    b := tx.Bucket(messageBucket).Bucket(qid)
+    if b == nil {
+      return ErrNotFound
+    }
+    return boltGet(b, id, m)
+  })
+  if err == nil && m.Expired() {
+    err = ErrNotFound
+  }
+  return m, err
+}
+
+// Delete message
+func (s *boltStore) DestroyMessage(m *Message) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(messageBucket).Bucket([]byte(m.QueueID))
+    if b == nil {
+      return ErrNotFound
+    }
+    q, stored := new(Queue), new(Message)
+    if err := boltGet(b, m.ID, stored); err != nil {
+      return err
+    }
+    if err := boltGet(tx.Bucket(queueBucket), m.QueueID, q); err != nil {
+      return err
+    }
+    return boltDestroyMessage(tx, q, stored)
+  })
+}
+
+// Counts of unexpired messages in queue
+func (s *boltStore) QueueStats(q *Queue, now time.Time) (*QueueStats, error) {
+  stats := newQueueStats()
+  err := s.db.View(func(tx *bolt.Tx) error {
+    msgs, err := boltLoadMessages(tx, q.ID, now)
+    for _, m := range msgs {
+      stats.add(m, now)
+    }
+    return err
+  })
+  return stats, err
+}
+
+// Delete all messages from queue
+func (s *boltStore) ClearMessages(q *Queue) (int, error) {
+  count := 0
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(messageBucket).Bucket([]byte(q.ID))
+    if b == nil {
+      return nil
+    }
+    count = b.Stats().KeyN
+    return boltClearMessages(tx, q.ID)
+  })
+  return count, err
+}
+
+// Lease unexpired messages whose lease expired
+// Selection and update happen in the same transaction so messages cannot be
+// handed out twice
+func (s *boltStore) LeaseMessages(q *Queue, count int, filter map[string]string, now, until time.Time) (*[]*Message, error) {
+  res := make([]*Message, 0, count)
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    if tx.Bucket(messageBucket).Bucket([]byte(q.ID)) == nil {
+      return ErrNotFound
+    }
+    x, err := boltOpenIndex(tx, q)
+    if err != nil {
+      return err
+    }
+    if err := x.promote(now); err != nil {
+      return err
+    }
+    candidates := make([]*Message, 0, count)
+    if count > 0 {
+      err = x.walk(boltLeasable, func(m *Message) (bool, error) {
+        if m.leasable(q, now) && m.hasAttributes(filter) {
+          head, err := x.groupHead(m, now)
+          if err != nil {
+            return false, err
+          }
+          if head {
+            candidates = append(candidates, m)
+          }
+        }
+        return len(candidates) < count, nil
+      })
+      if err != nil {
+        return err
+      }
+    }
+    for _, m := range candidates {
+      if err := x.remove(m); err != nil {
+        return err
+      }
+      m.LeaseExpiresAt = until
+      m.Attempts += 1
+      m.Receipt = newReceipt()
+      if err := boltPut(x.messages, m.ID, m); err != nil {
+        return err
+      }
+      if err := x.add(m); err != nil {
+        return err
+      }
+      res = append(res, m)
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &res, nil
+}
+
+// Extend lease of leased message
+func (s *boltStore) ExtendLease(q *Queue, id bson.ObjectId, receipt string, now, until time.Time) (*Message, error) {
+  m := new(Message)
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(messageBucket).Bucket([]byte(q.ID))
+    if b == nil {
+      return ErrNotFound
+    }
+    if err := boltGet(b, id, m); err != nil {
+      return err
+    }
+    if m.Receipt != receipt || !m.leased(now) {
+      return ErrNotFound
+    }
+    x, err := boltOpenIndex(tx, q)
+    if err != nil {
+      return err
+    }
+    if err := x.remove(m); err != nil {
+      return err
+    }
+    m.LeaseExpiresAt = until
+    if err := boltPut(b, m.ID, m); err != nil {
+      return err
+    }
+    return x.add(m)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return m, nil
+}
+
+// Release leased message
+func (s *boltStore) ReleaseMessage(q *Queue, id bson.ObjectId, receipt string, now, visibleAt time.Time) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(messageBucket).Bucket([]byte(q.ID))
+    if b == nil {
+      return ErrNotFound
+    }
+    m := new(Message)
+    if err := boltGet(b, id, m); err != nil {
+      return err
+    }
+    if m.Receipt != receipt || !m.leased(now) {
+      return ErrNotFound
+    }
+    x, err := boltOpenIndex(tx, q)
+    if err != nil {
+      return err
+    }
+    if err := x.remove(m); err != nil {
+      return err
+    }
+    m.LeaseExpiresAt, m.VisibleAt, m.Receipt = visibleAt, visibleAt, ""
+    if err := boltPut(b, m.ID, m); err != nil {
+      return err
+    }
+    return x.add(m)
+  })
+}
+
+// Delete leased message
+func (s *boltStore) DestroyLeasedMessage(q *Queue, id bson.ObjectId, receipt string) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(messageBucket).Bucket([]byte(q.ID))
+    if b == nil {
+      return ErrNotFound
+    }
+    m := new(Message)
+    if err := boltGet(b, id, m); err != nil {
+      return err
+    }
+    if m.Receipt != receipt {
+      return ErrNotFound
+    }
+    return boltDestroyMessage(tx, q, m)
+  })
+}
+
+// Move poisoned messages to dead-letter queue
+func (s *boltStore) DeadLetterMessages(q, dlq *Queue, now time.Time) (int, error) {
+  count := 0
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    if tx.Bucket(messageBucket).Bucket([]byte(q.ID)) == nil {
+      return ErrNotFound
+    }
+    x, err := boltOpenIndex(tx, q)
+    if err != nil {
+      return err
+    }
+    if err := x.promote(now); err != nil {
+      return err
+    }
+    poisoned := make([]*Message, 0)
+    err = x.walk(boltPoisoned, func(m *Message) (bool, error) {
+      if m.poisoned(q, now) {
+        poisoned = append(poisoned, m)
+      }
+      return true, nil
+    })
+    if err != nil {
+      return err
+    }
+    for _, m := range poisoned {
+      m.OriginQueueID, m.Attempts = q.ID, 0
+      if err := boltMoveMessage(tx, m, q, dlq); err != nil {
+        return err
+      }
+      count += 1
+    }
+    return nil
+  })
+  return count, err
+}
+
+// Move dead-lettered messages back to their origin queue
+func (s *boltStore) RedriveMessages(dlq, q *Queue, now time.Time, max int) (int, error) {
+  count := 0
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    msgs, err := boltLoadMessages(tx, dlq.ID, now)
+    if err != nil {
+      return err
+    }
+    for _, m := range msgs {
+      if count >= max {
+        break
+      }
+      if m.OriginQueueID != q.ID || !m.available(now) {
+        continue
+      }
+      m.OriginQueueID, m.Attempts = "", 0
+      if err := boltMoveMessage(tx, m, dlq, q); err != nil {
+        return err
+      }
+      count += 1
+    }
+    return nil
+  })
+  return count, err
+}
+
+// Delete up to 'max' expired messages from queue
+func (s *boltStore) DestroyExpiredMessages(q *Queue, now time.Time, max int) (int, error) {
+  count := 0
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    if tx.Bucket(messageBucket).Bucket([]byte(q.ID)) == nil {
+      return ErrNotFound
+    }
+    x, err := boltOpenIndex(tx, q)
+    if err != nil {
+      return err
+    }
+    expired := make([]*Message, 0)
+    c, limit := x.expiry.Cursor(), boltTime(now)
+    for k, v := c.First(); k != nil && len(expired) < max && bytes.Compare(k[:8], limit) < 0; k, v = c.Next() {
+      m := new(Message)
+      if err := boltGet(x.messages, bson.ObjectId(v), m); err != nil {
+        return err
+      }
+      expired = append(expired, m)
+    }
+    for _, m := range expired {
+      if err := boltDestroyMessage(tx, q, m); err != nil {
+        return err
+      }
+    }
+    count = len(expired)
+    if count == 0 {
+      return nil
+    }
+    stored := new(Queue)
+    if err := boltGet(tx.Bucket(queueBucket), q.ID, stored); err != nil {
+      return err
+    }
+    stored.ExpiredCount += count
+    return boltPut(tx.Bucket(queueBucket), q.ID, stored)
+  })
+  return count, err
+}
+
+// Save deduplication record unless an unexpired one exists for the same id
+// Records are keyed by deduplication id so there can only be one per queue
+func (s *boltStore) ClaimDeduplication(d *Deduplication, now time.Time) (*Deduplication, error) {
+  res := d
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    b, err := tx.Bucket(dedupBucket).CreateBucketIfNotExists([]byte(d.QueueID))
+    if err != nil {
+      return err
+    }
+    if raw := b.Get([]byte(d.DeduplicationID)); raw != nil {
+      existing := new(Deduplication)
+      if err := boltUnmarshal(raw, existing); err != nil {
+        return err
+      }
+      if !existing.ExpiresAt.Before(now) {
+        res = existing
+        return nil
+      }
+    }
+    raw, err := bson.Marshal(d)
+    if err != nil {
+      return err
+    }
+    return b.Put([]byte(d.DeduplicationID), raw)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return res, nil
+}
+
+// Delete deduplication record
+func (s *boltStore) DestroyDeduplication(d *Deduplication) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(dedupBucket).Bucket([]byte(d.QueueID))
+    if b == nil {
+      return ErrNotFound
+    }
+    raw := b.Get([]byte(d.DeduplicationID))
+    if raw == nil {
+      return ErrNotFound
+    }
+    existing := new(Deduplication)
+    if err := boltUnmarshal(raw, existing); err != nil {
+      return err
+    }
+    if existing.ID != d.ID {
+      return ErrNotFound
+    }
+    return b.Delete([]byte(d.DeduplicationID))
+  })
+}
+
+// Delete up to 'max' expired deduplication records from queue
+func (s *boltStore) DestroyExpiredDeduplications(q *Queue, now time.Time, max int) (int, error) {
+  count := 0
+  err := s.db.Update(func(tx *bolt.Tx) error {
+    b := tx.Bucket(dedupBucket).Bucket([]byte(q.ID))
+    if b == nil {
+      return nil
+    }
+    expired := make([][]byte, 0)
+    err := b.ForEach(func(k, v []byte) error {
+      if len(expired) >= max {
+        return nil
+      }
+      var d Deduplication
+      if err := boltUnmarshal(v, &d); err != nil {
+        return err
+      }
+      if d.ExpiresAt.Before(now) {
+        expired = append(expired, append([]byte(nil), k...))
+      }
+      return nil
+    })
+    if err != nil {
+      return err
+    }
+    for _, k := range expired {
+      if err := b.Delete(k); err != nil {
+        return err
+      }
+    }
+    count = len(expired)
+    return nil
+  })
+  return count, err
+}
+
+// Delete all deduplication records of queue
+func (s *boltStore) ClearDeduplications(q *Queue) error {
+  return s.db.Update(func(tx *bolt.Tx) error {
+    err := tx.Bucket(dedupBucket).DeleteBucket([]byte(q.ID))
+    if err == bolt.ErrBucketNotFound {
+      return nil
+    }
+    return err
+  })
+}
+
+// Find project with given name, return nil if not found
+func boltFindProject(tx *bolt.Tx, name string) (*Project, error) {
+  var found *Project
+  err := tx.Bucket(projectBucket).ForEach(func(k, v []byte) error {
+    var p Project
+    if err := boltUnmarshal(v, &p); err != nil {
+      return err
+    }
+    if p.Name == name {
+      found = &p
+    }
+    return nil
+  })
+  return found, err
+}
+
+// Find queue with given name in given project, return nil if not found
+func boltFindQueue(tx *bolt.Tx, projectID bson.ObjectId, name string) (*Queue, error) {
+  var found *Queue
+  err := tx.Bucket(queueBucket).ForEach(func(k, v []byte) error {
+    var q Queue
+    if err := boltUnmarshal(v, &q); err != nil {
+      return err
+    }
+    if q.ProjectID == projectID && q.Name == name {
+      found = &q
+    }
+    return nil
+  })
+  return found, err
+}
+
+// Find topic with given name in project with given id, return nil if not found
+func boltFindTopic(tx *bolt.Tx, projectID bson.ObjectId, name string) (*Topic, error) {
+  var found *Topic
+  err := tx.Bucket(topicBucket).ForEach(func(k, v []byte) error {
+    var t Topic
+    if err := boltUnmarshal(v, &t); err != nil {
+      return err
+    }
+    if t.ProjectID == projectID && t.Name == name {
+      found = &t
+    }
+    return nil
+  })
+  return found, err
+}
+
+// Find subscriptions of topic with given id, return subscription of queue
+// with given id only if queue id is not empty
+func boltFindSubscriptions(tx *bolt.Tx, topicID, queueID bson.ObjectId) ([]Subscription, error) {
+  subs := make([]Subscription, 0)
+  err := tx.Bucket(subscriptionBucket).ForEach(func(k, v []byte) error {
+    var sub Subscription
+    if err := boltUnmarshal(v, &sub); err != nil {
+      return err
+    }
+    if sub.TopicID == topicID && (queueID == "" || sub.QueueID == queueID) {
+      subs = append(subs, sub)
+    }
+    return nil
+  })
+  return subs, err
+}
+
+// Find tokens for which match returns true
+func boltFindTokens(tx *bolt.Tx, match func(t *Token) bool) ([]Token, error) {
+  ts := make([]Token, 0)
+  err := tx.Bucket(tokenBucket).ForEach(func(k, v []byte) error {
+    var t Token
+    if err := boltUnmarshal(v, &t); err != nil {
+      return err
+    }
+    if match(&t) {
+      ts = append(ts, t)
+    }
+    return nil
+  })
+  return ts, err
+}
+
+// Find subscribers of queue with given id, return subscribers with given name
+// only if name is not empty
+func boltFindSubscribers(tx *bolt.Tx, queueID bson.ObjectId, name string) ([]Subscriber, error) {
+  subs := make([]Subscriber, 0)
+  err := tx.Bucket(subscriberBucket).ForEach(func(k, v []byte) error {
+    var sub Subscriber
+    if err := boltUnmarshal(v, &sub); err != nil {
+      return err
+    }
+    if sub.QueueID == queueID && (name == "" || sub.Name == name) {
+      subs = append(subs, sub)
+    }
+    return nil
+  })
+  return subs, err
+}
+
+// Load all messages from queue with given id that have not expired at 'now'
+func boltLoadMessages(tx *bolt.Tx, qid bson.ObjectId, now time.Time) ([]*Message, error) {
+  b := tx.Bucket(messageBucket).Bucket([]byte(qid))
+  if b == nil {
+    return nil, ErrNotFound
+  }
+  msgs := make([]*Message, 0)
+  err := b.ForEach(func(k, v []byte) error {
+    m := new(Message)
+    if err := boltUnmarshal(v, m); err != nil {
+      return err
+    }
+    if !m.ExpiresAt.Before(now) {
+      msgs = append(msgs, m)
+    }
+    return nil
+  })
+  return msgs, err
+}
+
+// Move message from queue 'from' to queue 'to' and save it
+func boltMoveMessage(tx *bolt.Tx, m *Message, from, to *Queue) error {
+  fromIndex, err := boltOpenIndex(tx, from)
+  if err != nil {
+    return err
+  }
+  toIndex, err := boltOpenIndex(tx, to)
+  if err != nil {
+    return err
+  }
+  if err := fromIndex.remove(m); err != nil {
+    return err
+  }
+  if err := fromIndex.messages.Delete([]byte(m.ID)); err != nil {
+    return err
+  }
+  m.QueueID = to.ID
+  if err := boltPut(toIndex.messages, m.ID, m); err != nil {
+    return err
+  }
+  if err := toIndex.add(m); err != nil {
+    return err
+  }
+  return tx.Bucket(messageQueueBucket).Put([]byte(m.ID), []byte(to.ID))
+}
+
+// Delete message from queue and its indexes
+func boltDestroyMessage(tx *bolt.Tx, q *Queue, m *Message) error {
+  x, err := boltOpenIndex(tx, q)
+  if err != nil {
+    return err
+  }
+  if err := x.remove(m); err != nil {
+    return err
+  }
+  if err := boltDelete(x.messages, m.ID); err != nil {
+    return err
+  }
+  return tx.Bucket(messageQueueBucket).Delete([]byte(m.ID))
+}
+
+// Delete all messages from queue with given id
+func boltClearMessages(tx *bolt.Tx, qid bson.ObjectId) error {
+  b := tx.Bucket(messageBucket).Bucket([]byte(qid))
+  if b == nil {
+    return nil
+  }
+  ids := make([][]byte, 0)
+  b.ForEach(func(k, v []byte) error {
+    ids = append(ids, append([]byte(nil), k...))
+    return nil
+  })
+  for _, id := range ids {
+    if err := b.Delete(id); err != nil {
+      return err
+    }
+    if err := tx.Bucket(messageQueueBucket).Delete(id); err != nil {
+      return err
+    }
+  }
+  if err := tx.Bucket(messageIndexBucket).DeleteBucket([]byte(qid)); err != nil && err != bolt.ErrBucketNotFound {
+    return err
+  }
+  return nil
+}
+
+// Serialize document and store it under given id
+func boltPut(b *bolt.Bucket, id bson.ObjectId, doc interface{}) error {
+  raw, err := bson.Marshal(doc)
+  if err != nil {
+    return err
+  }
+  return b.Put([]byte(id), raw)
+}
+
+// Load document with given id, return ErrNotFound if there is none
+func boltGet(b *bolt.Bucket, id bson.ObjectId, doc interface{}) error {
+  raw := b.Get([]byte(id))
+  if raw == nil {
+    return ErrNotFound
+  }
+  return boltUnmarshal(raw, doc)
+}
+
+// Deserialize stored document
+// Values returned by bolt are only valid during the transaction and bson does
+// not copy binary fields (e.g. message bodies) so deserialize a copy
+func boltUnmarshal(raw []byte, doc interface{}) error {
+  return bson.Unmarshal(append([]byte(nil), raw...), doc)
+}
+
+// Delete document with given id, return ErrNotFound if there is none
+func boltDelete(b *bolt.Bucket, id bson.ObjectId) error {
+  if b.Get([]byte(id)) == nil {
+    return ErrNotFound
+  }
+  return b.Delete([]byte(id))
+}
+
+// Indexes of the messages of a queue, see Layout
+type boltIndex struct {
+  queue    *Queue       // Queue whose messages are indexed
+  messages *bolt.Bucket // Message bucket of queue
+  ready    *bolt.Bucket // Messages neither leased nor delayed in lease order
+  waiting  *bolt.Bucket // Leased or delayed messages by lease expiry time
+  expiry   *bolt.Bucket // All messages by expiry time
+  group    *bolt.Bucket // Messages in a group by group and creation time
+}
+
+// Open indexes of given queue, create them if needed
+func boltOpenIndex(tx *bolt.Tx, q *Queue) (*boltIndex, error) {
+  messages := tx.Bucket(messageBucket).Bucket([]byte(q.ID))
+  if messages == nil {
+    return nil, ErrNotFound
+  }
+  root, err := tx.Bucket(messageIndexBucket).CreateBucketIfNotExists([]byte(q.ID))
+  if err != nil {
+    return nil, err
+  }
+  x := &boltIndex{queue: q, messages: messages}
+  buckets := []**bolt.Bucket{&x.ready, &x.waiting, &x.expiry, &x.group}
+  for i, name := range [][]byte{readyIndex, waitingIndex, expiryIndex, groupIndex} {
+    if *buckets[i], err = root.CreateBucketIfNotExists(name); err != nil {
+      return nil, err
+    }
+  }
+  return x, nil
+}
+
+// Add message to indexes, messages that were leased or delayed go to the
+// waiting index even if their lease expired, see promote
+func (x *boltIndex) add(m *Message) error {
+  id := []byte(m.ID)
+  if m.LeaseExpiresAt.IsZero() {
+    if err := x.ready.Put(x.readyKey(m, x.poisoned(m)), id); err != nil {
+      return err
+    }
+  } else if err := x.waiting.Put(boltKey(id, boltTime(m.LeaseExpiresAt)), id); err != nil {
+    return err
+  }
+  if err := x.expiry.Put(boltKey(id, boltTime(m.ExpiresAt)), id); err != nil {
+    return err
+  }
+  if m.GroupID != "" {
+    return x.group.Put(boltKey(id, boltGroup(m.GroupID), boltTime(m.CreatedAt)), id)
+  }
+  return nil
+}
+
+// Remove message from indexes, 'm' must be the message as it was indexed
+// except for its number of attempts
+func (x *boltIndex) remove(m *Message) error {
+  id := []byte(m.ID)
+  if err := x.ready.Delete(x.readyKey(m, false)); err != nil {
+    return err
+  }
+  if err := x.ready.Delete(x.readyKey(m, true)); err != nil {
+    return err
+  }
+  if !m.LeaseExpiresAt.IsZero() {
+    if err := x.waiting.Delete(boltKey(id, boltTime(m.LeaseExpiresAt))); err != nil {
+      return err
+    }
+  }
+  if err := x.expiry.Delete(boltKey(id, boltTime(m.ExpiresAt))); err != nil {
+    return err
+  }
+  if m.GroupID != "" {
+    return x.group.Delete(boltKey(id, boltGroup(m.GroupID), boltTime(m.CreatedAt)))
+  }
+  return nil
+}
+
+// Move messages whose lease expired or that became visible before 'now' from
+// the waiting index to the ready index
+func (x *boltIndex) promote(now time.Time) error {
+  due := make([]*Message, 0)
+  c, limit := x.waiting.Cursor(), boltTime(now)
+  for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) < 0; k, v = c.Next() {
+    m := new(Message)
+    if err := boltGet(x.messages, bson.ObjectId(v), m); err != nil {
+      return err
+    }
+    due = append(due, m)
+  }
+  for _, m := range due {
+    if err := x.waiting.Delete(boltKey([]byte(m.ID), boltTime(m.LeaseExpiresAt))); err != nil {
+      return err
+    }
+    if err := x.ready.Put(x.readyKey(m, x.poisoned(m)), []byte(m.ID)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Call visit with messages of the ready index in lease order, only messages
+// that were leased MaxAttempts times if flag is boltPoisoned and only the
+// others if it is boltLeasable
+// Stop as soon as visit returns false or an error
+// The index must not be modified until walk returns
+func (x *boltIndex) walk(flag byte, visit func(m *Message) (bool, error)) error {
+  c := x.ready.Cursor()
+  for k, v := c.Seek([]byte{flag}); k != nil && k[0] == flag; k, v = c.Next() {
+    m := new(Message)
+    if err := boltGet(x.messages, bson.ObjectId(v), m); err != nil {
+      return err
+    }
+    if more, err := visit(m); err != nil || !more {
+      return err
+    }
+  }
+  return nil
+}
+
+// Whether message does not belong to a group or is the oldest unexpired
+// message of its group, see Message.groupHead
+func (x *boltIndex) groupHead(m *Message, now time.Time) (bool, error) {
+  if m.GroupID == "" {
+    return true, nil
+  }
+  prefix := boltGroup(m.GroupID)
+  c := x.group.Cursor()
+  for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+    if bson.ObjectId(v) == m.ID {
+      return true, nil
+    }
+    other := new(Message)
+    if err := boltGet(x.messages, bson.ObjectId(v), other); err != nil {
+      return false, err
+    }
+    if !other.ExpiresAt.Before(now) {
+      return false, nil
+    }
+  }
+  return false, nil
+}
+
+// Whether message was leased MaxAttempts times
+func (x *boltIndex) poisoned(m *Message) bool {
+  return x.queue.MaxAttempts > 0 && m.Attempts >= x.queue.MaxAttempts
+}
+
+// Key of message in ready index: flag, priority, creation time and id so that
+// keys sort in the order defined by the queue ordering (see messageSorter)
+func (x *boltIndex) readyKey(m *Message, poisoned bool) []byte {
+  flag, priority := boltLeasable, make([]byte, 8)
+  if poisoned {
+    flag = boltPoisoned
+  }
+  ordering := x.queue.ordering()
+  if ordering == OrderPriority {
+    binary.BigEndian.PutUint64(priority, ^(uint64(m.Priority) ^ 1<<63))
+  }
+  key := boltKey([]byte(m.ID), []byte{flag}, priority, boltTime(m.CreatedAt))
+  if ordering == OrderLIFO {
+    for i := 1 + 8; i < len(key); i++ {
+      key[i] = ^key[i]
+    }
+  }
+  return key
+}
+
+// Concatenate key parts followed by message id
+func boltKey(id []byte, parts ...[]byte) []byte {
+  key := make([]byte, 0, 32)
+  for _, p := range parts {
+    key = append(key, p...)
+  }
+  return append(key, id...)
+}
+
+// Big endian encoding of timestamp in milliseconds, as stored by BSON, so that
+// encoded timestamps sort in time order
+func boltTime(t time.Time) []byte {
+  b := make([]byte, 8)
+  binary.BigEndian.PutUint64(b, uint64(t.Unix()*1000+int64(t.Nanosecond()/1e6))^1<<63)
+  return b
+}
+
+// Prefix of group index keys of messages in given group
+func boltGroup(group string) []byte {
+  b := make([]byte, 2, 2+len(group))
+  binary.BigEndian.PutUint16(b, uint16(len(group)))
+  return append(b, group...)
+}
@@ -0,0 +1,685 @@
+package gotcha
+
+/*
+  This file implements the Store interface in memory
+
+  Nothing is persisted, all projects, queues and messages are lost when the
+  process exits. This is useful for tests and single node development.
+
+  Usage:
+    Storage = NewMemoryStore()
+*/
+
+import (
+  "errors"
+  "fmt"
+  "labix.org/v2/mgo/bson"
+  "sync"
+  "time"
+)
+
+// In-memory storage, all access is guarded by mutex
+// Values are copied in and out so callers never share memory with the store
+type memoryStore struct {
+  mutex         sync.RWMutex
+  projects      map[bson.ObjectId]*Project
+  queues        map[bson.ObjectId]*Queue
+  topics        map[bson.ObjectId]*Topic
+  subscriptions map[bson.ObjectId]*Subscription
+  subscribers   map[bson.ObjectId]*Subscriber
+  tokens        map[bson.ObjectId]*Token
+  messages      map[bson.ObjectId]map[bson.ObjectId]*Message // Messages indexed by queue id then message id
+  index         map[bson.ObjectId]bson.ObjectId              // Queue id indexed by message id
+  dedups        map[bson.ObjectId]map[string]*Deduplication  // Deduplication records indexed by queue id then deduplication id
+}
+
+// Create new empty in-memory store
+func NewMemoryStore() Store {
+  return &memoryStore{
+    projects:      make(map[bson.ObjectId]*Project),
+    queues:        make(map[bson.ObjectId]*Queue),
+    topics:        make(map[bson.ObjectId]*Topic),
+    subscriptions: make(map[bson.ObjectId]*Subscription),
+    subscribers:   make(map[bson.ObjectId]*Subscriber),
+    tokens:        make(map[bson.ObjectId]*Token),
+    messages:      make(map[bson.ObjectId]map[bson.ObjectId]*Message),
+    index:         make(map[bson.ObjectId]bson.ObjectId),
+    dedups:        make(map[bson.ObjectId]map[string]*Deduplication),
+  }
+}
+
+// List all projects
+func (s *memoryStore) ListProjects() (*[]Project, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  ps := make([]Project, 0, len(s.projects))
+  for _, p := range s.projects {
+    ps = append(ps, *p)
+  }
+  return &ps, nil
+}
+
+// Save new project, names must be unique
+func (s *memoryStore) InsertProject(p *Project) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.projects {
+    if other.Name == p.Name {
+      return errors.New(fmt.Sprintf("Project '%v' already exists", p.Name))
+    }
+  }
+  c := *p
+  s.projects[p.ID] = &c
+  return nil
+}
+
+// Load project with given name
+func (s *memoryStore) LoadProject(name string) (*Project, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, p := range s.projects {
+    if p.Name == name {
+      c := *p
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Load project with given id
+func (s *memoryStore) LoadProjectId(id bson.ObjectId) (*Project, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  p, ok := s.projects[id]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  c := *p
+  return &c, nil
+}
+
+// Delete project
+func (s *memoryStore) DestroyProject(p *Project) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.projects[p.ID]; !ok {
+    return ErrNotFound
+  }
+  delete(s.projects, p.ID)
+  return nil
+}
+
+// List all queues in project
+func (s *memoryStore) ListQueues(p *Project) (*[]Queue, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  qs := make([]Queue, 0)
+  for _, q := range s.queues {
+    if q.ProjectID == p.ID {
+      qs = append(qs, *q)
+    }
+  }
+  return &qs, nil
+}
+
+// Number of queues in project
+func (s *memoryStore) CountQueues(p *Project) (int, error) {
+  qs, err := s.ListQueues(p)
+  if err != nil {
+    return 0, err
+  }
+  return len(*qs), nil
+}
+
+// Save new queue, names must be unique in project
+func (s *memoryStore) InsertQueue(q *Queue) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.queues {
+    if other.ProjectID == q.ProjectID && other.Name == q.Name {
+      return errors.New(fmt.Sprintf("Queue '%v' already exists", q.Name))
+    }
+  }
+  c := *q
+  s.queues[q.ID] = &c
+  s.messages[q.ID] = make(map[bson.ObjectId]*Message)
+  return nil
+}
+
+// Load queue with given name from project
+func (s *memoryStore) LoadQueue(p *Project, name string) (*Queue, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, q := range s.queues {
+    if q.ProjectID == p.ID && q.Name == name {
+      c := *q
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Load queue with given id
+func (s *memoryStore) LoadQueueId(id bson.ObjectId) (*Queue, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  q, ok := s.queues[id]
+  if !ok {
+    return nil, ErrNotFound
+  }
+  c := *q
+  return &c, nil
+}
+
+// Delete queue
+func (s *memoryStore) DestroyQueue(q *Queue) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.queues[q.ID]; !ok {
+    return ErrNotFound
+  }
+  for id := range s.messages[q.ID] {
+    delete(s.index, id)
+  }
+  delete(s.messages, q.ID)
+  delete(s.queues, q.ID)
+  return nil
+}
+
+// List all topics in project
+func (s *memoryStore) ListTopics(p *Project) (*[]Topic, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  ts := make([]Topic, 0)
+  for _, t := range s.topics {
+    if t.ProjectID == p.ID {
+      ts = append(ts, *t)
+    }
+  }
+  return &ts, nil
+}
+
+// Save new topic, names must be unique in project
+func (s *memoryStore) InsertTopic(t *Topic) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.topics {
+    if other.ProjectID == t.ProjectID && other.Name == t.Name {
+      return errors.New(fmt.Sprintf("Topic '%v' already exists", t.Name))
+    }
+  }
+  c := *t
+  s.topics[t.ID] = &c
+  return nil
+}
+
+// Load topic with given name from project
+func (s *memoryStore) LoadTopic(p *Project, name string) (*Topic, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, t := range s.topics {
+    if t.ProjectID == p.ID && t.Name == name {
+      c := *t
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Delete topic
+func (s *memoryStore) DestroyTopic(t *Topic) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.topics[t.ID]; !ok {
+    return ErrNotFound
+  }
+  delete(s.topics, t.ID)
+  return nil
+}
+
+// List all subscriptions of topic
+func (s *memoryStore) ListSubscriptions(t *Topic) (*[]Subscription, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  subs := make([]Subscription, 0)
+  for _, sub := range s.subscriptions {
+    if sub.TopicID == t.ID {
+      subs = append(subs, *sub)
+    }
+  }
+  return &subs, nil
+}
+
+// Save new subscription, at most one per topic and queue
+func (s *memoryStore) InsertSubscription(sub *Subscription) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.subscriptions {
+    if other.TopicID == sub.TopicID && other.QueueID == sub.QueueID {
+      return errors.New("Queue is already subscribed to topic")
+    }
+  }
+  c := *sub
+  s.subscriptions[sub.ID] = &c
+  return nil
+}
+
+// Load subscription of given queue to topic
+func (s *memoryStore) LoadSubscription(t *Topic, q *Queue) (*Subscription, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, sub := range s.subscriptions {
+    if sub.TopicID == t.ID && sub.QueueID == q.ID {
+      c := *sub
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Delete subscription
+func (s *memoryStore) DestroySubscription(sub *Subscription) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.subscriptions[sub.ID]; !ok {
+    return ErrNotFound
+  }
+  delete(s.subscriptions, sub.ID)
+  return nil
+}
+
+// List all subscribers of queue
+func (s *memoryStore) ListSubscribers(q *Queue) (*[]Subscriber, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  subs := make([]Subscriber, 0)
+  for _, sub := range s.subscribers {
+    if sub.QueueID == q.ID {
+      subs = append(subs, *sub)
+    }
+  }
+  return &subs, nil
+}
+
+// Save new subscriber, names must be unique in queue
+func (s *memoryStore) InsertSubscriber(sub *Subscriber) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.subscribers {
+    if other.QueueID == sub.QueueID && other.Name == sub.Name {
+      return errors.New(fmt.Sprintf("Subscriber '%v' already exists", sub.Name))
+    }
+  }
+  c := *sub
+  s.subscribers[sub.ID] = &c
+  return nil
+}
+
+// Load subscriber with given name from queue
+func (s *memoryStore) LoadSubscriber(q *Queue, name string) (*Subscriber, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, sub := range s.subscribers {
+    if sub.QueueID == q.ID && sub.Name == name {
+      c := *sub
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Delete subscriber
+func (s *memoryStore) DestroySubscriber(sub *Subscriber) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.subscribers[sub.ID]; !ok {
+    return ErrNotFound
+  }
+  delete(s.subscribers, sub.ID)
+  return nil
+}
+
+// List all tokens of project
+func (s *memoryStore) ListTokens(p *Project) (*[]Token, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  ts := make([]Token, 0)
+  for _, t := range s.tokens {
+    if t.ProjectID == p.ID {
+      ts = append(ts, *t)
+    }
+  }
+  return &ts, nil
+}
+
+// Save new token, names must be unique in project
+func (s *memoryStore) InsertToken(t *Token) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, other := range s.tokens {
+    if other.ProjectID == t.ProjectID && other.Name == t.Name {
+      return errors.New(fmt.Sprintf("Token '%v' already exists", t.Name))
+    }
+  }
+  c := *t
+  s.tokens[t.ID] = &c
+  return nil
+}
+
+// Load token with given name from project
+func (s *memoryStore) LoadToken(p *Project, name string) (*Token, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, t := range s.tokens {
+    if t.ProjectID == p.ID && t.Name == name {
+      c := *t
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Load token with given secret hash
+func (s *memoryStore) LoadTokenHash(hash string) (*Token, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  for _, t := range s.tokens {
+    if t.Hash == hash {
+      c := *t
+      return &c, nil
+    }
+  }
+  return nil, ErrNotFound
+}
+
+// Delete token
+func (s *memoryStore) DestroyToken(t *Token) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.tokens[t.ID]; !ok {
+    return ErrNotFound
+  }
+  delete(s.tokens, t.ID)
+  return nil
+}
+
+// Save new messages, queue must exist
+func (s *memoryStore) InsertMessages(messages *[]*Message) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, m := range *messages {
+    if _, ok := s.messages[m.QueueID]; !ok {
+      return errors.New(fmt.Sprintf("Queue with id %v does not exist", m.QueueID.Hex()))
+    }
+  }
+  for _, m := range *messages {
+    c := *m
+    s.messages[m.QueueID][m.ID] = &c
+    s.index[m.ID] = m.QueueID
+  }
+  return nil
+}
+
+// Load message with given id
+func (s *memoryStore) LoadMessage(id bson.ObjectId) (*Message, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  m := s.lookup(id)
+  if m == nil || m.Expired() {
+    return nil, ErrNotFound
+  }
+  c := *m
+  return &c, nil
+}
+
+// Delete message
+func (s *memoryStore) DestroyMessage(m *Message) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if s.lookup(m.ID) == nil {
+    return ErrNotFound
+  }
+  s.remove(m.ID)
+  return nil
+}
+
+// Counts of unexpired messages in queue
+func (s *memoryStore) QueueStats(q *Queue, now time.Time) (*QueueStats, error) {
+  s.mutex.RLock()
+  defer s.mutex.RUnlock()
+  stats := newQueueStats()
+  for _, m := range s.messages[q.ID] {
+    if !m.ExpiresAt.Before(now) {
+      stats.add(m, now)
+    }
+  }
+  return stats, nil
+}
+
+// Delete all messages from queue
+func (s *memoryStore) ClearMessages(q *Queue) (int, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  msgs, ok := s.messages[q.ID]
+  if !ok {
+    return 0, nil
+  }
+  count := len(msgs)
+  for id := range msgs {
+    delete(s.index, id)
+  }
+  s.messages[q.ID] = make(map[bson.ObjectId]*Message)
+  return count, nil
+}
+
+// Lease unexpired messages whose lease expired
+func (s *memoryStore) LeaseMessages(q *Queue, count int, filter map[string]string, now, until time.Time) (*[]*Message, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  unexpired := make([]*Message, 0, len(s.messages[q.ID]))
+  for _, m := range s.messages[q.ID] {
+    if !m.ExpiresAt.Before(now) {
+      unexpired = append(unexpired, m)
+    }
+  }
+  heads := groupHeads(unexpired)
+  candidates := make([]*Message, 0)
+  for _, m := range unexpired {
+    if m.leasable(q, now) && m.hasAttributes(filter) && m.groupHead(heads) {
+      candidates = append(candidates, m)
+    }
+  }
+  sortMessages(candidates, q.ordering())
+  if len(candidates) > count {
+    candidates = candidates[:count]
+  }
+  res := make([]*Message, 0, len(candidates))
+  for _, m := range candidates {
+    m.LeaseExpiresAt = until
+    m.Attempts += 1
+    m.Receipt = newReceipt()
+    c := *m
+    res = append(res, &c)
+  }
+  return &res, nil
+}
+
+// Extend lease of leased message
+func (s *memoryStore) ExtendLease(q *Queue, id bson.ObjectId, receipt string, now, until time.Time) (*Message, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  m := s.lookup(id)
+  if m == nil || m.QueueID != q.ID || m.Receipt != receipt || !m.leased(now) {
+    return nil, ErrNotFound
+  }
+  m.LeaseExpiresAt = until
+  c := *m
+  return &c, nil
+}
+
+// Release leased message
+func (s *memoryStore) ReleaseMessage(q *Queue, id bson.ObjectId, receipt string, now, visibleAt time.Time) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  m := s.lookup(id)
+  if m == nil || m.QueueID != q.ID || m.Receipt != receipt || !m.leased(now) {
+    return ErrNotFound
+  }
+  m.LeaseExpiresAt, m.VisibleAt, m.Receipt = visibleAt, visibleAt, ""
+  return nil
+}
+
+// Delete leased message
+func (s *memoryStore) DestroyLeasedMessage(q *Queue, id bson.ObjectId, receipt string) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  m := s.lookup(id)
+  if m == nil || m.QueueID != q.ID || m.Receipt != receipt {
+    return ErrNotFound
+  }
+  s.remove(id)
+  return nil
+}
+
+// Move poisoned messages to dead-letter queue
+func (s *memoryStore) DeadLetterMessages(q, dlq *Queue, now time.Time) (int, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.messages[dlq.ID]; !ok {
+    return 0, ErrNotFound
+  }
+  count := 0
+  for _, m := range s.messages[q.ID] {
+    if m.poisoned(q, now) {
+      s.move(m, dlq.ID)
+      m.OriginQueueID, m.Attempts = q.ID, 0
+      count += 1
+    }
+  }
+  return count, nil
+}
+
+// Move dead-lettered messages back to their origin queue
+func (s *memoryStore) RedriveMessages(dlq, q *Queue, now time.Time, max int) (int, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  if _, ok := s.messages[q.ID]; !ok {
+    return 0, ErrNotFound
+  }
+  count := 0
+  for _, m := range s.messages[dlq.ID] {
+    if count >= max {
+      break
+    }
+    if m.OriginQueueID == q.ID && m.available(now) {
+      s.move(m, q.ID)
+      m.OriginQueueID, m.Attempts = "", 0
+      count += 1
+    }
+  }
+  return count, nil
+}
+
+// Delete up to 'max' expired messages from queue
+func (s *memoryStore) DestroyExpiredMessages(q *Queue, now time.Time, max int) (int, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  count := 0
+  for id, m := range s.messages[q.ID] {
+    if count >= max {
+      break
+    }
+    if m.ExpiresAt.Before(now) {
+      s.remove(id)
+      count += 1
+    }
+  }
+  if stored, ok := s.queues[q.ID]; ok {
+    stored.ExpiredCount += count
+  }
+  return count, nil
+}
+
+// Save deduplication record unless an unexpired one exists for the same id
+func (s *memoryStore) ClaimDeduplication(d *Deduplication, now time.Time) (*Deduplication, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  ds, ok := s.dedups[d.QueueID]
+  if !ok {
+    ds = make(map[string]*Deduplication)
+    s.dedups[d.QueueID] = ds
+  }
+  if existing, ok := ds[d.DeduplicationID]; ok && !existing.ExpiresAt.Before(now) {
+    c := *existing
+    return &c, nil
+  }
+  c := *d
+  ds[d.DeduplicationID] = &c
+  return d, nil
+}
+
+// Delete deduplication record
+func (s *memoryStore) DestroyDeduplication(d *Deduplication) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  existing, ok := s.dedups[d.QueueID][d.DeduplicationID]
+  if !ok || existing.ID != d.ID {
+    return ErrNotFound
+  }
+  delete(s.dedups[d.QueueID], d.DeduplicationID)
+  return nil
+}
+
+// Delete up to 'max' expired deduplication records from queue
+func (s *memoryStore) DestroyExpiredDeduplications(q *Queue, now time.Time, max int) (int, error) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  count := 0
+  for id, d := range s.dedups[q.ID] {
+    if count >= max {
+      break
+    }
+    if d.ExpiresAt.Before(now) {
+      delete(s.dedups[q.ID], id)
+      count += 1
+    }
+  }
+  return count, nil
+}
+
+// Delete all deduplication records of queue
+func (s *memoryStore) ClearDeduplications(q *Queue) error {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  delete(s.dedups, q.ID)
+  return nil
+}
+
+// Nothing to release
+func (s *memoryStore) Close() {
+}
+
+// Message with given id if any, mutex must be held
+func (s *memoryStore) lookup(id bson.ObjectId) *Message {
+  qid, ok := s.index[id]
+  if !ok {
+    return nil
+  }
+  return s.messages[qid][id]
+}
+
+// Move message to queue with given id, write lock must be held
+func (s *memoryStore) move(m *Message, qid bson.ObjectId) {
+  delete(s.messages[m.QueueID], m.ID)
+  m.QueueID = qid
+  s.messages[qid][m.ID] = m
+  s.index[m.ID] = qid
+}
+
+// Delete message with given id, mutex must be held
+func (s *memoryStore) remove(id bson.ObjectId) {
+  if qid, ok := s.index[id]; ok {
+    delete(s.messages[qid], id)
+    delete(s.index, id)
+  }
+}
@@ -1,19 +1,47 @@
 package gotcha
 
 import (
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "fmt"
   "labix.org/v2/mgo/bson"
+  "log"
+  "regexp"
+  "sort"
   "time"
 )
 
 // Internal message datastructure
 type Message struct {
-  ID             bson.ObjectId "_id,omitempty"    // ID
-  Body           string        "body"             // Message body (UTF-8 encoded)
-  QueueID        bson.ObjectId "queue"            // ID of queue containing message
-  ProjectID      bson.ObjectId "project"          // ID of project containing message
-  ExpiresAt      time.Time     "expires_at"       // Expiry timestamp (message is deleted after that time)
-  CreatedAt      time.Time     "created_at"       // Creation timestamp
-  LeaseExpiresAt time.Time     "lease_expires_at" // Lease expiry timestamp if any
+  ID              bson.ObjectId     "_id,omitempty"          // ID
+  Body            []byte            "body"                   // Message body (UTF-8 encoded unless Binary is set)
+  Binary          bool              "binary,omitempty"       // Whether body is arbitrary bytes rather than UTF-8 text
+  QueueID         bson.ObjectId     "queue"                  // ID of queue containing message
+  ProjectID       bson.ObjectId     "project"                // ID of project containing message
+  ExpiresAt       time.Time         "expires_at"             // Expiry timestamp (message is deleted after that time)
+  CreatedAt       time.Time         "created_at"             // Creation timestamp
+  LeaseExpiresAt  time.Time         "lease_expires_at"       // Lease expiry timestamp if any
+  Priority        int               "priority"               // Priority, higher first (only used by queues with priority ordering)
+  VisibleAt       time.Time         "visible_at"             // Timestamp at which delayed message can first be leased if any
+  Attempts        int               "attempts"               // Number of times message was leased
+  OriginQueueID   bson.ObjectId     "origin_queue,omitempty" // ID of queue message was dead-lettered from if any
+  Receipt         string            "receipt,omitempty"      // Receipt handle of last lease if any
+  Attributes      map[string]string "attributes,omitempty"   // Attributes (e.g. content type), used to filter messages
+  DeduplicationID string            "-"                      // Deduplication id given when enqueueing if any (not persisted)
+  GroupID         string            "group_id,omitempty"     // Group of messages processed one at a time in enqueue order if any
+}
+
+// Record of the message enqueued with a given deduplication id
+// Messages enqueued with the same deduplication id in the same queue before
+// the record expires are not saved, they are given the id of the recorded
+// message instead
+type Deduplication struct {
+  ID              bson.ObjectId "_id,omitempty"    // ID
+  QueueID         bson.ObjectId "queue"            // ID of queue message was enqueued in
+  DeduplicationID string        "deduplication_id" // Deduplication id given when enqueueing (unique in queue)
+  MessageID       bson.ObjectId "message"          // ID of enqueued message
+  ExpiresAt       time.Time     "expires_at"       // End of deduplication window
 }
 
 // Default expiry is set to 7 days
@@ -25,28 +53,233 @@ const MinMessageExpiry = time.Duration(1) * time.Minute
 // Maximum expiry time for message is set to 30 days
 const MaxMessageExpiry = time.Duration(30 * 24) * time.Hour
 
-// Load message with given Id
+// Maximum delay before message can be leased is set to 15 days
+const MaxMessageDelay = time.Duration(15 * 24) * time.Hour
+
+// Lowest message priority
+const MinMessagePriority = -100
+
+// Highest message priority
+const MaxMessagePriority = 100
+
+// Maximum number of attributes a single message can have
+const MaxMessageAttributes = 16
+
+// Maximum total size of attribute names and values of a single message in bytes
+const MaxAttributesSize = 4096
+
+// Attribute names may only contain letters, digits, '-' and '_' so they can
+// be used as keys by all stores
+var attributeName = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+
+// Check that attributes (or attribute filter) are within limits
+func ValidateAttributes(attrs map[string]string) error {
+  if len(attrs) > MaxMessageAttributes {
+    return errors.New(fmt.Sprintf("Too many attributes (%v max)", MaxMessageAttributes))
+  }
+  size := 0
+  for k, v := range attrs {
+    if !attributeName.MatchString(k) {
+      return errors.New(fmt.Sprintf("Invalid attribute name '%v' (must be 1 to 64 letters, digits, '-' or '_')", k))
+    }
+    size += len(k) + len(v)
+  }
+  if size > MaxAttributesSize {
+    return errors.New(fmt.Sprintf("Attributes are too large (%v bytes max)", MaxAttributesSize))
+  }
+  return nil
+}
+
+// Load message with given Id (hex representation)
 func LoadMessage(id string) (*Message, error) {
-  m := new(Message)
-  err := Mongo.GetId("message", bson.ObjectId(id), m)
-  return m, err
+  if !bson.IsObjectIdHex(id) {
+    return nil, ErrNotFound
+  }
+  return Storage.LoadMessage(bson.ObjectIdHex(id))
 }
 
 // Save messages to database
+// Messages whose deduplication id was already used in their queue within the
+// queue deduplication window are not saved, their id is set to the id of the
+// message that was saved instead
+// Wake up consumers waiting for messages in queues where messages can be
+// leased right away
 func SaveMessages(messages *[]*Message) error {
-  msgs := make([]interface{}, 0, len(*messages))
-  for _, msg := range *messages {
-    msgs = append(msgs, msg)
+  now := time.Now().UTC()
+  fresh, claims, err := deduplicate(*messages, now)
+  if err != nil {
+    return err
+  }
+  if len(fresh) > 0 {
+    if err := Storage.InsertMessages(&fresh); err != nil {
+      releaseDeduplications(claims)
+      return err
+    }
+  }
+  notified := make(map[bson.ObjectId]bool)
+  for _, m := range fresh {
+    if !notified[m.QueueID] && !m.Delayed(now) {
+      notify(m.QueueID)
+      notified[m.QueueID] = true
+    }
+  }
+  return nil
+}
+
+// Record deduplication ids of messages, return messages that must be saved
+// and the records created for them
+// Messages whose deduplication id is already recorded are given the id of
+// the recorded message and left out
+func deduplicate(messages []*Message, now time.Time) ([]*Message, []*Deduplication, error) {
+  fresh := make([]*Message, 0, len(messages))
+  claims := make([]*Deduplication, 0)
+  windows := make(map[bson.ObjectId]time.Duration)
+  for _, m := range messages {
+    if m.DeduplicationID == "" {
+      fresh = append(fresh, m)
+      continue
+    }
+    window, ok := windows[m.QueueID]
+    if !ok {
+      q, err := Storage.LoadQueueId(m.QueueID)
+      if err != nil {
+        releaseDeduplications(claims)
+        return nil, nil, err
+      }
+      window = q.deduplicationWindow()
+      windows[m.QueueID] = window
+    }
+    d := Deduplication{ID: bson.NewObjectId(), QueueID: m.QueueID, DeduplicationID: m.DeduplicationID, MessageID: m.ID,
+      ExpiresAt: now.Add(window)}
+    recorded, err := Storage.ClaimDeduplication(&d, now)
+    if err != nil {
+      releaseDeduplications(claims)
+      return nil, nil, err
+    }
+    if recorded.MessageID != m.ID {
+      m.ID = recorded.MessageID
+      continue
+    }
+    fresh = append(fresh, m)
+    claims = append(claims, recorded)
+  }
+  return fresh, claims, nil
+}
+
+// Delete deduplication records of messages that could not be saved so that
+// the messages can be enqueued again
+func releaseDeduplications(claims []*Deduplication) {
+  for _, d := range claims {
+    if err := Storage.DestroyDeduplication(d); err != nil {
+      log.Printf("**ERROR: Failed to delete deduplication record %v: %v", d.ID.Hex(), err)
+    }
   }
-  return Mongo.Insert("message", msgs...)
 }
 
 // Delete message from database
 func (m *Message) Destroy() error {
-  return Mongo.DestroyId("message", m.ID)
+  return Storage.DestroyMessage(m)
+}
+
+// Generate new unique lease receipt handle
+func newReceipt() string {
+  b := make([]byte, 16)
+  if _, err := rand.Read(b); err != nil {
+    log.Panicf("Failed to generate lease receipt: %v", err)
+  }
+  return hex.EncodeToString(b)
+}
+
+// Generate new random identifier that cannot be guessed (e.g. to identify
+// message streams)
+func NewRandomID() string {
+  return newReceipt()
+}
+
+// Whether message is delayed at given time (i.e. cannot be leased yet)
+func (m *Message) Delayed(now time.Time) bool {
+  return m.VisibleAt.After(now)
+}
+
+// Whether message has all the given attributes
+func (m *Message) hasAttributes(attrs map[string]string) bool {
+  for k, v := range attrs {
+    if a, ok := m.Attributes[k]; !ok || a != v {
+      return false
+    }
+  }
+  return true
+}
+
+// Oldest message of each group among given unexpired messages
+// Only these messages can be leased, see groupHead
+func groupHeads(messages []*Message) map[string]*Message {
+  heads := make(map[string]*Message)
+  for _, m := range messages {
+    if m.GroupID == "" {
+      continue
+    }
+    if h, ok := heads[m.GroupID]; !ok || m.CreatedAt.Before(h.CreatedAt) || (m.CreatedAt.Equal(h.CreatedAt) && m.ID < h.ID) {
+      heads[m.GroupID] = m
+    }
+  }
+  return heads
+}
+
+// Whether message does not belong to a group or is the oldest message of its
+// group given the heads computed by groupHeads
+// Messages of a group are leased one at a time: the next message can only be
+// leased once the head is deleted (or expires or is dead-lettered)
+func (m *Message) groupHead(heads map[string]*Message) bool {
+  return m.GroupID == "" || heads[m.GroupID].ID == m.ID
+}
+
+// Whether message can be leased from given queue at given time
+func (m *Message) leasable(q *Queue, now time.Time) bool {
+  return m.available(now) && (q.MaxAttempts == 0 || m.Attempts < q.MaxAttempts)
+}
+
+// Whether message must be moved to dead-letter queue of given queue at given time
+func (m *Message) poisoned(q *Queue, now time.Time) bool {
+  return m.available(now) && q.MaxAttempts > 0 && m.Attempts >= q.MaxAttempts
+}
+
+// Whether message is unexpired and leased at given time
+func (m *Message) leased(now time.Time) bool {
+  return !m.LeaseExpiresAt.Before(now) && !m.Delayed(now) && !m.ExpiresAt.Before(now)
+}
+
+// Whether message is unexpired and neither leased nor delayed at given time
+func (m *Message) available(now time.Time) bool {
+  return m.LeaseExpiresAt.Before(now) && !m.ExpiresAt.Before(now)
 }
 
 // Whether message is expired
 func (m *Message) Expired() bool {
   return m.ExpiresAt.Before(time.Now().UTC())
 }
+
+// Sort messages in the order they must be leased given queue ordering
+func sortMessages(messages []*Message, ordering string) {
+  sort.Sort(messageSorter{messages: messages, ordering: ordering})
+}
+
+// Sort messages according to queue ordering, see Order* constants
+// Messages created at the same time are sorted by id
+type messageSorter struct {
+  messages []*Message
+  ordering string
+}
+
+func (s messageSorter) Len() int      { return len(s.messages) }
+func (s messageSorter) Swap(i, j int) { s.messages[i], s.messages[j] = s.messages[j], s.messages[i] }
+func (s messageSorter) Less(i, j int) bool {
+  a, b := s.messages[i], s.messages[j]
+  if s.ordering == OrderPriority && a.Priority != b.Priority {
+    return a.Priority > b.Priority
+  }
+  if s.ordering == OrderLIFO {
+    a, b = b, a
+  }
+  return a.CreatedAt.Before(b.CreatedAt) || (a.CreatedAt.Equal(b.CreatedAt) && a.ID < b.ID)
+}
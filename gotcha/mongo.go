@@ -1,7 +1,8 @@
 package gotcha
 
 /*
-  This file encapsulates access to MongoDB
+  This file encapsulates access to MongoDB and implements the Store interface
+  on top of it
 
   Usage:
     StartSession("localhost", "user", "password", "development")
@@ -19,14 +20,21 @@ package gotcha
     Get: Retrieve documents matching given query from given collection
     GetOne: Retrieve first document matching given query from given collection
     Count: Count number of documents matching given query
+    GetIds: Retrieve ids of documents matching given query
+    Update: Update all documents matching given query
     DeleteId: Delete document with given id from given collection
     Delete: Delete all documents matching given query from given collection
+
+  StartSession also sets 'Storage' so that projects, queues and messages are
+  stored in MongoDB.
 */
 
 import (
   "labix.org/v2/mgo"
   "labix.org/v2/mgo/bson"
   "log"
+  "math"
+  "time"
 )
 
 // Current session if any
@@ -47,6 +55,7 @@ func StartSession(host, user, pass, env string) error {
     log.Print("Closing existing MongoDB session prior to opening a new one")
     Mongo.Close()
     Mongo = nil
+    Storage = nil
   }
 
   // Initialize connection and login
@@ -71,15 +80,44 @@ func StartSession(host, user, pass, env string) error {
   if err := createIndex(db, "queue", []string{"project", "name"}, true); err != nil {
     return err
   }
-  if err := createIndex(db, "message", []string{"project", "queue", "lease_expires_at"}, false); err != nil {
+  if err := createIndex(db, "topic", []string{"project", "name"}, true); err != nil {
+    return err
+  }
+  if err := createIndex(db, "subscription", []string{"topic", "queue"}, true); err != nil {
+    return err
+  }
+  if err := createIndex(db, "subscriber", []string{"queue", "name"}, true); err != nil {
+    return err
+  }
+  if err := createIndex(db, "token", []string{"project", "name"}, true); err != nil {
+    return err
+  }
+  if err := createIndex(db, "token", []string{"hash"}, true); err != nil {
+    return err
+  }
+  // Priority queues lease messages sorted by priority then creation time
+  if err := createIndex(db, "message", []string{"project", "queue", "-priority", "created_at"}, false); err != nil {
     return err
   }
   if err := createIndex(db, "message", []string{"created_at"}, false); err != nil {
     return err
   }
+  if err := createIndex(db, "message", []string{"project", "queue", "expires_at"}, false); err != nil {
+    return err
+  }
+  if err := createIndex(db, "message", []string{"queue", "group_id", "created_at"}, false); err != nil {
+    return err
+  }
+  if err := createIndex(db, "deduplication", []string{"queue", "deduplication_id"}, true); err != nil {
+    return err
+  }
+  if err := createIndex(db, "deduplication", []string{"queue", "expires_at"}, false); err != nil {
+    return err
+  }
 
-  // Finally, initialize 'Mongo'
+  // Finally, initialize 'Mongo' and use it as storage
   Mongo = &session{mgoSession: s, db: db}
+  Storage = Mongo
 
   return nil
 }
@@ -141,6 +179,24 @@ func (s *session) Get(col string, query bson.M, maxCount int, docs interface{})
   return err
 }
 
+// Retrieve ids of up to 'maxCount' documents matching given query
+func (s *session) GetIds(col string, query bson.M, maxCount int) ([]bson.ObjectId, error) {
+  docs := make([]struct {
+    ID bson.ObjectId "_id"
+  }, 0)
+  c := s.db.C(col)
+  err := c.Find(query).Select(bson.M{"_id": 1}).Limit(maxCount).All(&docs)
+  if err != nil {
+    log.Printf("**ERROR: Failed to run query %v in collection %v: %v", query, col, err)
+    return nil, err
+  }
+  ids := make([]bson.ObjectId, 0, len(docs))
+  for _, d := range docs {
+    ids = append(ids, d.ID)
+  }
+  return ids, nil
+}
+
 // Retrieve one document using given query
 func (s *session) GetOne(col string, query bson.M, doc interface{}) error {
   c := s.db.C(col)
@@ -161,17 +217,42 @@ func (s *session) Count(col string, query bson.M) (int, error) {
   return count, err
 }
 
+// Update all documents that match given query
+// Return number of updated documents
+func (s *session) Update(col string, query bson.M, update bson.M) (int, error) {
+  c := s.db.C(col)
+  info, err := c.UpdateAll(query, update)
+  if err != nil {
+    log.Printf("**ERROR: Failed to update with query %v in collection %v: %v", query, col, err)
+    return 0, err
+  }
+  return info.Updated, nil
+}
+
 // Update multiple messages and retrieve them
 // Each update on each message is atomic with the query used to retrieve it
+// Each updated message is also given a new lease receipt
 // This uses MongoDB 'findAndModify' which can only act on one document at a time
 // so this loops until the desired count is updated/retrieved
-func (s *session) FindAndUpdateMessages(query bson.M, update bson.M, sort string, maxCount int) (*[]*Message, error) {
+func (s *session) FindAndUpdateMessages(query bson.M, update bson.M, sort []string, maxCount int) (*[]*Message, error) {
   c := s.db.C("message")
-  change := mgo.Change{Update: update, ReturnNew: true}
   res := make([]*Message, 0, maxCount)
   for i := 0; i < maxCount; i++ {
+    set := bson.M{"receipt": newReceipt()}
+    if fields, ok := update["$set"].(bson.M); ok {
+      for k, v := range fields {
+        set[k] = v
+      }
+    }
+    u := bson.M{"$set": set}
+    for k, v := range update {
+      if k != "$set" {
+        u[k] = v
+      }
+    }
+    change := mgo.Change{Update: u, ReturnNew: true}
     m := new(Message)
-    _, err := c.Find(query).Sort(sort).Apply(change, m)
+    _, err := c.Find(query).Sort(sort...).Apply(change, m)
     if err == mgo.ErrNotFound {
       break
     } else if err != nil {
@@ -199,7 +280,494 @@ func (s *session) Destroy(col string, query bson.M) (int, error) {
   info, err := c.RemoveAll(query)
   if err != nil {
     log.Printf("**ERROR: Failed to delete with query %v from collection %v: %v", query, col, err)
+    return 0, err
   }
-  return info.Removed, err
+  return info.Removed, nil
+}
+
+// Translate mgo "not found" error into storage agnostic error
+func notFound(err error) error {
+  if err == mgo.ErrNotFound {
+    return ErrNotFound
+  }
+  return err
+}
+
+/*
+  Store implementation
+*/
+
+// List all projects
+func (s *session) ListProjects() (*[]Project, error) {
+  ps := make([]Project, 0, 10)
+  err := s.Get("project", bson.M{}, math.MaxInt32, &ps)
+  return &ps, err
+}
+
+// Save new project
+func (s *session) InsertProject(p *Project) error {
+  return s.Insert("project", p)
+}
+
+// Load project with given name
+func (s *session) LoadProject(name string) (*Project, error) {
+  p := new(Project)
+  err := s.GetOne("project", bson.M{"name": name}, p)
+  return p, notFound(err)
+}
+
+// Load project with given id
+func (s *session) LoadProjectId(id bson.ObjectId) (*Project, error) {
+  p := new(Project)
+  err := s.GetId("project", id, p)
+  return p, notFound(err)
+}
+
+// Delete project
+func (s *session) DestroyProject(p *Project) error {
+  return notFound(s.DestroyId("project", p.ID))
+}
+
+// List all queues in project
+func (s *session) ListQueues(p *Project) (*[]Queue, error) {
+  qs := make([]Queue, 0)
+  err := s.Get("queue", bson.M{"project": p.ID}, MaxQueuesPerProject, &qs)
+  return &qs, err
+}
+
+// Number of queues in project
+func (s *session) CountQueues(p *Project) (int, error) {
+  return s.Count("queue", bson.M{"project": p.ID})
+}
+
+// Save new queue
+func (s *session) InsertQueue(q *Queue) error {
+  return s.Insert("queue", q)
+}
+
+// Load queue with given name from project
+func (s *session) LoadQueue(p *Project, name string) (*Queue, error) {
+  q := new(Queue)
+  err := s.GetOne("queue", bson.M{"project": p.ID, "name": name}, q)
+  return q, notFound(err)
+}
+
+// Load queue with given id
+func (s *session) LoadQueueId(id bson.ObjectId) (*Queue, error) {
+  q := new(Queue)
+  err := s.GetId("queue", id, q)
+  return q, notFound(err)
+}
+
+// Delete queue
+func (s *session) DestroyQueue(q *Queue) error {
+  return notFound(s.DestroyId("queue", q.ID))
+}
+
+// List all topics in project
+func (s *session) ListTopics(p *Project) (*[]Topic, error) {
+  ts := make([]Topic, 0)
+  err := s.Get("topic", bson.M{"project": p.ID}, MaxTopicsPerProject, &ts)
+  return &ts, err
+}
+
+// Save new topic
+func (s *session) InsertTopic(t *Topic) error {
+  return s.Insert("topic", t)
+}
+
+// Load topic with given name from project
+func (s *session) LoadTopic(p *Project, name string) (*Topic, error) {
+  t := new(Topic)
+  err := s.GetOne("topic", bson.M{"project": p.ID, "name": name}, t)
+  return t, notFound(err)
+}
+
+// Delete topic
+func (s *session) DestroyTopic(t *Topic) error {
+  return notFound(s.DestroyId("topic", t.ID))
+}
+
+// List all subscriptions of topic
+func (s *session) ListSubscriptions(t *Topic) (*[]Subscription, error) {
+  subs := make([]Subscription, 0)
+  err := s.Get("subscription", bson.M{"topic": t.ID}, MaxSubscriptionsPerTopic, &subs)
+  return &subs, err
+}
+
+// Save new subscription
+func (s *session) InsertSubscription(sub *Subscription) error {
+  return s.Insert("subscription", sub)
+}
+
+// Load subscription of given queue to topic
+func (s *session) LoadSubscription(t *Topic, q *Queue) (*Subscription, error) {
+  sub := new(Subscription)
+  err := s.GetOne("subscription", bson.M{"topic": t.ID, "queue": q.ID}, sub)
+  return sub, notFound(err)
+}
+
+// Delete subscription
+func (s *session) DestroySubscription(sub *Subscription) error {
+  return notFound(s.DestroyId("subscription", sub.ID))
+}
+
+// List all subscribers of queue
+func (s *session) ListSubscribers(q *Queue) (*[]Subscriber, error) {
+  subs := make([]Subscriber, 0)
+  err := s.Get("subscriber", bson.M{"queue": q.ID}, MaxSubscribersPerQueue, &subs)
+  return &subs, err
+}
+
+// Save new subscriber
+func (s *session) InsertSubscriber(sub *Subscriber) error {
+  return s.Insert("subscriber", sub)
+}
+
+// Load subscriber with given name from queue
+func (s *session) LoadSubscriber(q *Queue, name string) (*Subscriber, error) {
+  sub := new(Subscriber)
+  err := s.GetOne("subscriber", bson.M{"queue": q.ID, "name": name}, sub)
+  return sub, notFound(err)
+}
+
+// Delete subscriber
+func (s *session) DestroySubscriber(sub *Subscriber) error {
+  return notFound(s.DestroyId("subscriber", sub.ID))
+}
+
+// List all tokens of project
+func (s *session) ListTokens(p *Project) (*[]Token, error) {
+  ts := make([]Token, 0)
+  err := s.Get("token", bson.M{"project": p.ID}, MaxTokensPerProject, &ts)
+  return &ts, err
+}
+
+// Save new token
+func (s *session) InsertToken(t *Token) error {
+  return s.Insert("token", t)
+}
+
+// Load token with given name from project
+func (s *session) LoadToken(p *Project, name string) (*Token, error) {
+  t := new(Token)
+  err := s.GetOne("token", bson.M{"project": p.ID, "name": name}, t)
+  return t, notFound(err)
 }
 
+// Load token with given secret hash
+func (s *session) LoadTokenHash(hash string) (*Token, error) {
+  t := new(Token)
+  err := s.GetOne("token", bson.M{"hash": hash}, t)
+  return t, notFound(err)
+}
+
+// Delete token
+func (s *session) DestroyToken(t *Token) error {
+  return notFound(s.DestroyId("token", t.ID))
+}
+
+// Save new messages
+// MongoDB cannot insert multiple documents atomically so messages are first
+// inserted with their expiry stored in 'pending_expires_at' instead of
+// 'expires_at', which hides them from all queries, and then all revealed by a
+// single update. Messages are deleted if inserting or revealing them fails
+func (s *session) InsertMessages(messages *[]*Message) error {
+  if len(*messages) == 1 {
+    return s.Insert("message", (*messages)[0])
+  }
+  docs := make([]interface{}, 0, len(*messages))
+  ids := make([]bson.ObjectId, 0, len(*messages))
+  for _, msg := range *messages {
+    doc, err := pendingMessage(msg)
+    if err != nil {
+      return err
+    }
+    docs = append(docs, doc)
+    ids = append(ids, msg.ID)
+  }
+  err := s.Insert("message", docs...)
+  if err == nil {
+    _, err = s.Update("message", bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$rename": bson.M{"pending_expires_at": "expires_at"}})
+  }
+  if err != nil {
+    if _, derr := s.Destroy("message", bson.M{"_id": bson.M{"$in": ids}}); derr != nil {
+      log.Printf("**ERROR: Failed to delete partially saved messages %v: %v", ids, derr)
+    }
+  }
+  return err
+}
+
+// Document of message with its expiry moved to 'pending_expires_at'
+func pendingMessage(m *Message) (bson.M, error) {
+  raw, err := bson.Marshal(m)
+  if err != nil {
+    return nil, err
+  }
+  doc := bson.M{}
+  if err := bson.Unmarshal(raw, &doc); err != nil {
+    return nil, err
+  }
+  doc["pending_expires_at"] = doc["expires_at"]
+  delete(doc, "expires_at")
+  return doc, nil
+}
+
+// Load message with given id, expired messages are not returned
+func (s *session) LoadMessage(id bson.ObjectId) (*Message, error) {
+  m := new(Message)
+  err := s.GetId("message", id, m)
+  if err == nil && m.Expired() {
+    return nil, ErrNotFound
+  }
+  return m, notFound(err)
+}
+
+// Delete message
+func (s *session) DestroyMessage(m *Message) error {
+  return notFound(s.DestroyId("message", m.ID))
+}
+
+// Counts of unexpired messages in queue, aggregated by priority
+// Messages without 'visible_at' (created before delays existed) are never delayed
+func (s *session) QueueStats(q *Queue, now time.Time) (*QueueStats, error) {
+  res := make([]struct {
+    Priority int "_id"
+    Count    int "count"
+    Ready    int "ready"
+    Delayed  int "delayed"
+  }, 0)
+  isReady := bson.M{"$and": []bson.M{{"$lte": []interface{}{"$visible_at", now}}, {"$lt": []interface{}{"$lease_expires_at", now}}}}
+  isDelayed := bson.M{"$gt": []interface{}{"$visible_at", now}}
+  pipeline := []bson.M{
+    {"$match": bson.M{"project": q.ProjectID, "queue": q.ID, "expires_at": bson.M{"$gte": now}}},
+    {"$group": bson.M{
+      "_id":     "$priority",
+      "count":   bson.M{"$sum": 1},
+      "ready":   bson.M{"$sum": bson.M{"$cond": []interface{}{isReady, 1, 0}}},
+      "delayed": bson.M{"$sum": bson.M{"$cond": []interface{}{isDelayed, 1, 0}}},
+    }},
+  }
+  if err := s.db.C("message").Pipe(pipeline).All(&res); err != nil {
+    log.Printf("**ERROR: Failed to compute stats of queue %v: %v", q.ID.Hex(), err)
+    return nil, err
+  }
+  stats := newQueueStats()
+  for _, r := range res {
+    stats.Size += r.Count
+    stats.Ready += r.Ready
+    stats.Delayed += r.Delayed
+    stats.Priorities[r.Priority] += r.Count
+  }
+  var groups []string
+  err := s.db.C("message").Find(bson.M{"project": q.ProjectID, "queue": q.ID, "expires_at": bson.M{"$gte": now},
+    "group_id": bson.M{"$exists": true}}).Distinct("group_id", &groups)
+  if err != nil {
+    return nil, err
+  }
+  stats.Groups = len(groups)
+  return stats, nil
+}
+
+// Delete all messages from queue
+func (s *session) ClearMessages(q *Queue) (int, error) {
+  return s.Destroy("message", bson.M{"project": q.ProjectID, "queue": q.ID})
+}
+
+// Lease unexpired messages whose lease expired
+// Candidates are iterated in queue order and leased one by one with the
+// lease conditions repeated so that messages leased concurrently are skipped
+// Grouped messages are skipped unless they are the head of their group
+func (s *session) LeaseMessages(q *Queue, count int, filter map[string]string, now, until time.Time) (*[]*Message, error) {
+  query := bson.M{"project": q.ProjectID, "queue": q.ID, "lease_expires_at": bson.M{"$lt": now}, "expires_at": bson.M{"$gte": now}}
+  if q.MaxAttempts > 0 {
+    query["attempts"] = bson.M{"$lt": q.MaxAttempts}
+  }
+  for k, v := range filter {
+    query["attributes."+k] = v
+  }
+  update := bson.M{"$set": bson.M{"lease_expires_at": until}, "$inc": bson.M{"attempts": 1}}
+  c := s.db.C("message")
+  res := make([]*Message, 0, count)
+  heads := make(map[string]bson.ObjectId)
+  var doc struct {
+    ID      bson.ObjectId "_id"
+    GroupID string        "group_id"
+  }
+  iter := c.Find(query).Sort(mongoSort(q.ordering())...).Select(bson.M{"_id": 1, "group_id": 1}).Iter()
+  for len(res) < count && iter.Next(&doc) {
+    if doc.GroupID != "" {
+      head, ok := heads[doc.GroupID]
+      if !ok {
+        var h struct {
+          ID bson.ObjectId "_id"
+        }
+        err := c.Find(bson.M{"project": q.ProjectID, "queue": q.ID, "group_id": doc.GroupID, "expires_at": bson.M{"$gte": now}}).
+          Sort("created_at", "_id").Select(bson.M{"_id": 1}).One(&h)
+        if err != nil && err != mgo.ErrNotFound {
+          iter.Close()
+          return nil, err
+        }
+        head = h.ID
+        heads[doc.GroupID] = head
+      }
+      if head != doc.ID {
+        continue
+      }
+    }
+    byId := bson.M{"_id": doc.ID}
+    for k, v := range query {
+      byId[k] = v
+    }
+    leased, err := s.FindAndUpdateMessages(byId, update, nil, 1)
+    if err != nil {
+      iter.Close()
+      return nil, err
+    }
+    res = append(res, *leased...)
+  }
+  if err := iter.Close(); err != nil {
+    return nil, err
+  }
+  return &res, nil
+}
+
+// Extend lease of leased message
+func (s *session) ExtendLease(q *Queue, id bson.ObjectId, receipt string, now, until time.Time) (*Message, error) {
+  query := bson.M{"_id": id, "queue": q.ID, "receipt": receipt, "lease_expires_at": bson.M{"$gte": now},
+    "expires_at": bson.M{"$gte": now}, "visible_at": bson.M{"$not": bson.M{"$gt": now}}}
+  change := mgo.Change{Update: bson.M{"$set": bson.M{"lease_expires_at": until}}, ReturnNew: true}
+  m := new(Message)
+  if _, err := s.db.C("message").Find(query).Apply(change, m); err != nil {
+    return nil, notFound(err)
+  }
+  return m, nil
+}
+
+// Release leased message
+func (s *session) ReleaseMessage(q *Queue, id bson.ObjectId, receipt string, now, visibleAt time.Time) error {
+  query := bson.M{"_id": id, "queue": q.ID, "receipt": receipt, "lease_expires_at": bson.M{"$gte": now},
+    "expires_at": bson.M{"$gte": now}, "visible_at": bson.M{"$not": bson.M{"$gt": now}}}
+  n, err := s.Update("message", query, bson.M{"$set": bson.M{"lease_expires_at": visibleAt, "visible_at": visibleAt},
+    "$unset": bson.M{"receipt": 1}})
+  if err == nil && n == 0 {
+    err = ErrNotFound
+  }
+  return err
+}
+
+// Delete leased message
+func (s *session) DestroyLeasedMessage(q *Queue, id bson.ObjectId, receipt string) error {
+  n, err := s.Destroy("message", bson.M{"_id": id, "queue": q.ID, "receipt": receipt})
+  if err == nil && n == 0 {
+    err = ErrNotFound
+  }
+  return err
+}
+
+// Move poisoned messages to dead-letter queue
+func (s *session) DeadLetterMessages(q, dlq *Queue, now time.Time) (int, error) {
+  query := bson.M{"project": q.ProjectID, "queue": q.ID, "lease_expires_at": bson.M{"$lt": now}, "expires_at": bson.M{"$gte": now},
+    "attempts": bson.M{"$gte": q.MaxAttempts}}
+  return s.Update("message", query, bson.M{"$set": bson.M{"queue": dlq.ID, "origin_queue": q.ID, "attempts": 0}})
+}
+
+// Move dead-lettered messages back to their origin queue
+// MongoDB cannot limit updates so lookup ids first
+func (s *session) RedriveMessages(dlq, q *Queue, now time.Time, max int) (int, error) {
+  query := bson.M{"project": dlq.ProjectID, "queue": dlq.ID, "origin_queue": q.ID, "lease_expires_at": bson.M{"$lt": now},
+    "expires_at": bson.M{"$gte": now}}
+  ids, err := s.GetIds("message", query, max)
+  if err != nil || len(ids) == 0 {
+    return 0, err
+  }
+  return s.Update("message", bson.M{"_id": bson.M{"$in": ids}},
+    bson.M{"$set": bson.M{"queue": q.ID, "attempts": 0}, "$unset": bson.M{"origin_queue": 1}})
+}
+
+// Sort fields used to lease messages given queue ordering
+func mongoSort(ordering string) []string {
+  switch ordering {
+  case OrderLIFO:
+    return []string{"-created_at", "-_id"}
+  case OrderPriority:
+    return []string{"-priority", "created_at", "_id"}
+  }
+  return []string{"created_at", "_id"}
+}
+
+// Delete up to 'max' expired messages from queue and update its expired count
+// MongoDB cannot limit removals so lookup ids first
+// Messages left hidden by an interrupted InsertMessages are deleted once
+// they expire as well
+func (s *session) DestroyExpiredMessages(q *Queue, now time.Time, max int) (int, error) {
+  query := bson.M{"project": q.ProjectID, "queue": q.ID,
+    "$or": []bson.M{{"expires_at": bson.M{"$lt": now}}, {"pending_expires_at": bson.M{"$lt": now}}}}
+  ids, err := s.GetIds("message", query, max)
+  if err != nil || len(ids) == 0 {
+    return 0, err
+  }
+  count, err := s.Destroy("message", bson.M{"_id": bson.M{"$in": ids}})
+  if err != nil || count == 0 {
+    return count, err
+  }
+  err = s.db.C("queue").UpdateId(q.ID, bson.M{"$inc": bson.M{"expiredCount": count}})
+  if err != nil {
+    log.Printf("**ERROR: Failed to update expired count of queue %v: %v", q.ID.Hex(), err)
+  }
+  return count, err
+}
+
+// Save deduplication record unless an unexpired one exists for the same id
+// The unique index on queue and deduplication id makes concurrent claims
+// fail, expired records are taken over with an update conditioned on their
+// expiry so only one claim can win
+func (s *session) ClaimDeduplication(d *Deduplication, now time.Time) (*Deduplication, error) {
+  c := s.db.C("deduplication")
+  for {
+    err := c.Insert(d)
+    if err == nil {
+      return d, nil
+    } else if !mgo.IsDup(err) {
+      return nil, err
+    }
+    existing := new(Deduplication)
+    err = c.Find(bson.M{"queue": d.QueueID, "deduplication_id": d.DeduplicationID}).One(existing)
+    if err == mgo.ErrNotFound {
+      continue // Deleted in the meantime, try inserting again
+    } else if err != nil {
+      return nil, err
+    }
+    if !existing.ExpiresAt.Before(now) {
+      return existing, nil
+    }
+    err = c.Update(bson.M{"_id": existing.ID, "expires_at": existing.ExpiresAt},
+      bson.M{"$set": bson.M{"message": d.MessageID, "expires_at": d.ExpiresAt}})
+    if err == nil {
+      d.ID = existing.ID
+      return d, nil
+    } else if err != mgo.ErrNotFound {
+      return nil, err
+    }
+  }
+}
+
+// Delete deduplication record
+func (s *session) DestroyDeduplication(d *Deduplication) error {
+  return notFound(s.db.C("deduplication").Remove(bson.M{"_id": d.ID, "message": d.MessageID}))
+}
+
+// Delete up to 'max' expired deduplication records from queue
+func (s *session) DestroyExpiredDeduplications(q *Queue, now time.Time, max int) (int, error) {
+  ids, err := s.GetIds("deduplication", bson.M{"queue": q.ID, "expires_at": bson.M{"$lt": now}}, max)
+  if err != nil || len(ids) == 0 {
+    return 0, err
+  }
+  return s.Destroy("deduplication", bson.M{"_id": bson.M{"$in": ids}})
+}
+
+// Delete all deduplication records of queue
+func (s *session) ClearDeduplications(q *Queue) error {
+  _, err := s.Destroy("deduplication", bson.M{"queue": q.ID})
+  return err
+}
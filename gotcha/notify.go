@@ -0,0 +1,58 @@
+package gotcha
+
+/*
+  This file implements in-process notifications of consumers waiting for
+  messages to become available in a queue (see Queue.WaitMessages)
+
+  Queues are notified when messages are saved, released without delay or
+  redriven by this process. Messages becoming available because their lease
+  or delay expired or because they were added by another process do not
+  trigger notifications, waiting consumers only see them once they retry.
+*/
+
+import (
+  "labix.org/v2/mgo/bson"
+  "sync"
+)
+
+// Channels of consumers waiting for messages indexed by queue id
+var waiters = make(map[bson.ObjectId]map[chan bool]bool)
+
+// Protects 'waiters'
+var waitersMutex sync.Mutex
+
+// Register to be notified when messages are added to queue with given id
+// Must be followed by a call to unsubscribe with the returned channel
+func subscribe(queueID bson.ObjectId) chan bool {
+  c := make(chan bool, 1)
+  waitersMutex.Lock()
+  defer waitersMutex.Unlock()
+  if waiters[queueID] == nil {
+    waiters[queueID] = make(map[chan bool]bool)
+  }
+  waiters[queueID][c] = true
+  return c
+}
+
+// Stop being notified of messages added to queue with given id
+func unsubscribe(queueID bson.ObjectId, c chan bool) {
+  waitersMutex.Lock()
+  defer waitersMutex.Unlock()
+  delete(waiters[queueID], c)
+  if len(waiters[queueID]) == 0 {
+    delete(waiters, queueID)
+  }
+}
+
+// Wake up all consumers waiting for messages in queue with given id
+// Never blocks, consumers that were already notified are skipped
+func notify(queueID bson.ObjectId) {
+  waitersMutex.Lock()
+  defer waitersMutex.Unlock()
+  for c := range waiters[queueID] {
+    select {
+    case c <- true:
+    default:
+    }
+  }
+}
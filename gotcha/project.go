@@ -2,7 +2,6 @@ package gotcha
 
 import (
   "labix.org/v2/mgo/bson"
-  "math"
   "time"
 )
 
@@ -25,42 +24,34 @@ const MaxQueuesPerProject = 100000
 
 // List all projects
 func ListProjects() (*[]Project, error) {
-  ps := make([]Project, 0, 10)
-  err := Mongo.Get("project", bson.M{}, math.MaxInt32, &ps)
-  return &ps, err
+  return Storage.ListProjects()
 }
 
 // Create new project
 func NewProject(name string) (*Project, error) {
   p := Project{ID: bson.NewObjectId(), Name: name, CreatedAt: time.Now().UTC()}
-  err := Mongo.Insert("project", &p)
+  err := Storage.InsertProject(&p)
   return &p, err
 }
 
-// Load project by name, return nil if not found
+// Load project by name, return ErrNotFound if not found
 func LoadProject(name string) (*Project, error) {
-  p := new(Project)
-  err := Mongo.GetOne("project", bson.M{"name": name}, p)
-  return p, err
+  return Storage.LoadProject(name)
 }
 
 // Return all queues from given project
 func (p *Project) Queues() (*[]Queue, error) {
-  qs := make([]Queue, 0)
-  err := Mongo.Get("queue", bson.M{"project": p.ID}, MaxQueuesPerProject, &qs)
-  return &qs, err
+  return Storage.ListQueues(p)
 }
 
 // Return queue with given name from given project
 func (p *Project) Queue(name string) (*Queue, error) {
-  q := new(Queue)
-  err := Mongo.GetOne("queue", bson.M{"project": p.ID, "name": name}, q)
-  return q, err
+  return Storage.LoadQueue(p, name)
 }
 
 // Return info about this project
 func (p *Project) Info() (*ProjectInfo, error) {
-  count, err := Mongo.Count("queue", bson.M{"project": p.ID})
+  count, err := Storage.CountQueues(p)
   if err != nil {
     return nil, err
   }
@@ -69,15 +60,32 @@ func (p *Project) Info() (*ProjectInfo, error) {
 
 // Destroy project and all that it contains
 func (p *Project) Destroy() error {
-  qs := make([]*Queue, 0)
-  if err := Mongo.Get("queue", bson.M{"project": p.ID}, MaxQueuesPerProject, &qs); err != nil {
+  if ts, err := p.Topics(); err != nil {
     return err
   } else {
-    for _, q := range qs {
-      if err := q.Destroy(); err != nil {
+    for _, t := range *ts {
+      if err := t.Destroy(); err != nil {
         return err
       }
     }
   }
-  return Mongo.DestroyId("project", p.ID)
+  if qs, err := p.Queues(); err != nil {
+    return err
+  } else {
+    for _, q := range *qs {
+      if err := q.destroy(); err != nil {
+        return err
+      }
+    }
+  }
+  if ts, err := p.Tokens(); err != nil {
+    return err
+  } else {
+    for _, t := range *ts {
+      if err := t.Destroy(); err != nil {
+        return err
+      }
+    }
+  }
+  return Storage.DestroyProject(p)
 }
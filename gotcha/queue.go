@@ -1,42 +1,145 @@
 package gotcha
 
 import (
+  "encoding/base64"
   "errors"
   "fmt"
   "labix.org/v2/mgo/bson"
   "log"
+  "strconv"
   "time"
 )
 
 // Internal queue structure
 type Queue struct {
-  ID        bson.ObjectId "_id,omitempty" // ID
-  Name      string        "name"          // Name of queue (unique in project)
-  ProjectID bson.ObjectId "project"       // Project containing queue
-  CreatedAt time.Time     "createdAt"     // Creation timestamp
+  ID            bson.ObjectId "_id,omitempty" // ID
+  Name          string        "name"          // Name of queue (unique in project)
+  ProjectID     bson.ObjectId "project"       // Project containing queue
+  CreatedAt     time.Time     "createdAt"     // Creation timestamp
+  ExpiredCount  int           "expiredCount"  // Number of messages that expired before being consumed
+  QueueSettings ",inline"                     // Settings given at creation
+}
+
+// Queue settings given at creation
+type QueueSettings struct {
+  Ordering            string        "ordering"            // Order in which messages are leased, see Order* constants
+  MaxAttempts         int           "maxAttempts"         // Number of leases after which messages are dead-lettered, 0 means unlimited
+  DeadLetterQueue     string        "deadLetterQueue"     // Name of queue (in same project) receiving dead-lettered messages
+  DeduplicationWindow time.Duration "deduplicationWindow" // Time during which messages with the same deduplication id are enqueued once
+}
+
+// Maximum value for queue MaxAttempts setting
+const MaxMessageAttempts = 1000
+
+// Default deduplication window is 5 minutes
+const DefaultDeduplicationWindow = time.Duration(5) * time.Minute
+
+// Maximum deduplication window is 1 day
+const MaxDeduplicationWindow = time.Duration(24) * time.Hour
+
+// Queue ordering modes
+const (
+  OrderFIFO     = "fifo"     // Oldest messages first (default)
+  OrderLIFO     = "lifo"     // Newest messages first
+  OrderPriority = "priority" // Highest priority messages first, oldest first for same priority
+)
+
+// Message counts computed by storage backends
+type QueueStats struct {
+  Size       int             // Number of unexpired messages in queue
+  Ready      int             // Number of messages that can be leased
+  Delayed    int             // Number of messages that cannot be leased yet because of their delay
+  Priorities map[int]int     // Number of unexpired messages per priority
+  Groups     int             // Number of groups with unexpired messages
+  groups     map[string]bool // Groups counted so far (see add)
+}
+
+// Record message in stats
+func (s *QueueStats) add(m *Message, now time.Time) {
+  s.Size += 1
+  if m.Delayed(now) {
+    s.Delayed += 1
+  } else if m.LeaseExpiresAt.Before(now) {
+    s.Ready += 1
+  }
+  s.Priorities[m.Priority] += 1
+  if m.GroupID != "" && !s.groups[m.GroupID] {
+    s.groups[m.GroupID] = true
+    s.Groups += 1
+  }
+}
+
+// Create empty stats
+func newQueueStats() *QueueStats {
+  return &QueueStats{Priorities: make(map[int]int), groups: make(map[string]bool)}
 }
 
 // Queue information returned by APIs
 type QueueInfo struct {
-  Name        string    `json:"name"`      // Name of queue (unique in project)
-  ProjectName string    `json:"project"`   // Name of project containing queue
-  CreatedAt   time.Time `json:"createdAt"` // Creation timestamp
-  Size        int       `json:"size"`      // Number of messages in queue
+  Name                string         `json:"name"`                      // Name of queue (unique in project)
+  ProjectName         string         `json:"project"`                   // Name of project containing queue
+  CreatedAt           time.Time      `json:"createdAt"`                 // Creation timestamp
+  Size                int            `json:"size"`                      // Number of messages in queue
+  Ready               int            `json:"ready"`                     // Number of messages that can be leased
+  Delayed             int            `json:"delayed"`                   // Number of messages that cannot be leased yet
+  InFlight            int            `json:"inFlight"`                  // Number of leased messages
+  Expired             int            `json:"expired"`                   // Number of messages that expired before being consumed
+  Ordering            string         `json:"ordering"`                  // Order in which messages are leased
+  Priorities          map[string]int `json:"priorities,omitempty"`      // Number of messages per priority (priority ordering only)
+  MaxAttempts         int            `json:"maxAttempts,omitempty"`     // Number of leases after which messages are dead-lettered
+  DeadLetterQueue     string         `json:"deadLetterQueue,omitempty"` // Name of queue receiving dead-lettered messages
+  DeduplicationWindow int            `json:"deduplicationWindow"`       // Deduplication window in seconds
+  Groups              int            `json:"groups"`                    // Number of message groups with messages in queue
 }
 
 // Message information returned by APIs
 type MessageInfo struct {
-  ID               bson.ObjectId `json:"id"`               // ID
-  Body             string        `json:"body"`             // Message body (UTF-8)
-  QueueName        string        `json:"queue"`            // Name of queue containing message
-  ProjectName      string        `json:"project"`          // Name of project containing message
-  CreatedAt        time.Time     `json:"createdAt"`        // Creation timestamp
-  MessageExpiresAt time.Time     `json:"messageExpiresAt"` // Expiry timestamp
-  LeaseExpiresAt   time.Time     `json:"leaseExpiresAt"`   // Timeout of lease in seconds     
+  ID               bson.ObjectId     `json:"id"`                   // ID
+  Body             string            `json:"body"`                 // Message body (UTF-8 or base64 encoded, see Encoding)
+  Encoding         string            `json:"encoding,omitempty"`   // "base64" if message has a binary body, empty otherwise
+  QueueName        string            `json:"queue"`                // Name of queue containing message
+  ProjectName      string            `json:"project"`              // Name of project containing message
+  CreatedAt        time.Time         `json:"createdAt"`            // Creation timestamp
+  MessageExpiresAt time.Time         `json:"messageExpiresAt"`     // Expiry timestamp
+  LeaseExpiresAt   time.Time         `json:"leaseExpiresAt"`       // Timeout of lease in seconds
+  Receipt          string            `json:"receipt"`              // Receipt handle of lease, required to delete or touch message
+  Priority         int               `json:"priority"`             // Priority (queues with priority ordering only)
+  Attempts         int               `json:"attempts"`             // Number of times message was leased (including this one)
+  Attributes       map[string]string `json:"attributes,omitempty"` // Attributes set when message was added
+  GroupID          string            `json:"groupId,omitempty"`    // Group of message if any
 }
 
 // Create new queue
-func NewQueue(name string, project *Project) (*Queue, error) {
+// Ordering must be one of the Order* constants, default to FIFO if empty
+// Dead-letter queue must exist in project and is required if MaxAttempts is set
+// Deduplication window default to DefaultDeduplicationWindow if zero
+func NewQueue(name string, project *Project, settings QueueSettings) (*Queue, error) {
+  if settings.Ordering == "" {
+    settings.Ordering = OrderFIFO
+  }
+  if settings.DeduplicationWindow == 0 {
+    settings.DeduplicationWindow = DefaultDeduplicationWindow
+  }
+  if w := settings.DeduplicationWindow; w < time.Second || w > MaxDeduplicationWindow {
+    return nil, errors.New(fmt.Sprintf("Invalid deduplication window %v (must be >= 1s and <= %v)", w, MaxDeduplicationWindow))
+  }
+  if o := settings.Ordering; o != OrderFIFO && o != OrderLIFO && o != OrderPriority {
+    return nil, errors.New(fmt.Sprintf("Invalid ordering '%v' (must be one of '%v', '%v' or '%v')", o, OrderFIFO, OrderLIFO, OrderPriority))
+  }
+  if settings.MaxAttempts < 0 || settings.MaxAttempts > MaxMessageAttempts {
+    return nil, errors.New(fmt.Sprintf("Invalid maximum attempts %v (must be >= 0 and <= %v)", settings.MaxAttempts, MaxMessageAttempts))
+  }
+  if (settings.MaxAttempts > 0) != (settings.DeadLetterQueue != "") {
+    return nil, errors.New("Maximum attempts and dead-letter queue must be set together")
+  }
+  if settings.DeadLetterQueue != "" {
+    if settings.DeadLetterQueue == name {
+      return nil, errors.New("A queue cannot be its own dead-letter queue")
+    }
+    if _, err := project.Queue(settings.DeadLetterQueue); err != nil {
+      return nil, errors.New(fmt.Sprintf("Dead-letter queue '%v' not found in project '%v'", settings.DeadLetterQueue, project.Name))
+    }
+  }
   // Make sure we don't exceed the quota, no need to lock, it's OK if a few extras are created
   info, err := project.Info()
   if err != nil {
@@ -45,68 +148,367 @@ func NewQueue(name string, project *Project) (*Queue, error) {
   if info.QueueCount >= MaxQueuesPerProject {
     return nil, errors.New(fmt.Sprintf("Maximum number of queues (%v) reached for project '%v'", MaxQueuesPerProject, project.Name))
   }
-  q := Queue{ID: bson.NewObjectId(), Name: name, ProjectID: project.ID, CreatedAt: time.Now().UTC()}
-  Mongo.Insert("queue", &q)
+  q := Queue{ID: bson.NewObjectId(), Name: name, ProjectID: project.ID, CreatedAt: time.Now().UTC(), QueueSettings: settings}
+  if err := Storage.InsertQueue(&q); err != nil {
+    return nil, err
+  }
   return &q, nil
 }
 
 // Retrieve info about the queue
 func (q *Queue) Info() (*QueueInfo, error) {
-  size, err := Mongo.Count("message", bson.M{"project": q.ProjectID, "queue": q.ID})
+  stats, err := Storage.QueueStats(q, time.Now().UTC())
   if (err != nil) {
     return nil, err
   }
-  project := new(Project)
-  err = Mongo.GetId("project", q.ProjectID, &project)
+  project, err := Storage.LoadProjectId(q.ProjectID)
   if (err != nil) {
     return nil, err
   }
-  return &QueueInfo{Name: q.Name, ProjectName: project.Name, CreatedAt: q.CreatedAt, Size: size}, nil
+  info := QueueInfo{Name: q.Name, ProjectName: project.Name, CreatedAt: q.CreatedAt, Size: stats.Size, Ready: stats.Ready,
+    Delayed: stats.Delayed, InFlight: stats.Size - stats.Ready - stats.Delayed, Expired: q.ExpiredCount, Ordering: q.ordering()}
+  info.MaxAttempts, info.DeadLetterQueue = q.MaxAttempts, q.DeadLetterQueue
+  info.DeduplicationWindow, info.Groups = int(q.deduplicationWindow().Seconds()), stats.Groups
+  if q.ordering() == OrderPriority {
+    info.Priorities = make(map[string]int, len(stats.Priorities))
+    for priority, count := range stats.Priorities {
+      info.Priorities[strconv.Itoa(priority)] = count
+    }
+  }
+  return &info, nil
 }
 
+// Error returned when deleting a queue that is the dead-letter queue of
+// another queue of its project
+var ErrDeadLetterQueueInUse = errors.New("queue is the dead-letter queue of another queue")
+
 // Delete queue and all its messages
+// Return ErrDeadLetterQueueInUse if another queue of the project dead-letters
+// messages to it, these queues must be deleted first
 func (q *Queue) Destroy() error {
+  p, err := Storage.LoadProjectId(q.ProjectID)
+  if err != nil {
+    return err
+  }
+  qs, err := p.Queues()
+  if err != nil {
+    return err
+  }
+  for _, source := range *qs {
+    if source.ID != q.ID && source.DeadLetterQueue == q.Name {
+      return ErrDeadLetterQueueInUse
+    }
+  }
+  return q.destroy()
+}
+
+// Delete queue and all its messages regardless of other queues referencing it
+// (used when deleting the whole project)
+func (q *Queue) destroy() error {
+  if err := q.unsubscribe(); err != nil {
+    return err
+  }
+  if subs, err := q.Subscribers(); err != nil {
+    return err
+  } else {
+    for _, s := range *subs {
+      if err := s.Destroy(); err != nil {
+        return err
+      }
+    }
+  }
   err := q.Clear()
   if err != nil {
     return err
   }
-  return Mongo.DestroyId("queue", q.ID)
+  if err := Storage.ClearDeduplications(q); err != nil {
+    return err
+  }
+  return Storage.DestroyQueue(q)
+}
+
+// Queue ordering, queues created before ordering was introduced are FIFO
+func (q *Queue) ordering() string {
+  if q.Ordering == "" {
+    return OrderFIFO
+  }
+  return q.Ordering
+}
+
+// Whether queue was created with given settings, zero settings stand for
+// their default value as in NewQueue
+func (q *Queue) HasSettings(settings QueueSettings) bool {
+  other := Queue{QueueSettings: settings}
+  return q.ordering() == other.ordering() && q.MaxAttempts == settings.MaxAttempts &&
+    q.DeadLetterQueue == settings.DeadLetterQueue && q.deduplicationWindow() == other.deduplicationWindow()
+}
+
+// Queue deduplication window, queues created before deduplication was
+// introduced use the default window
+func (q *Queue) deduplicationWindow() time.Duration {
+  if q.DeduplicationWindow == 0 {
+    return DefaultDeduplicationWindow
+  }
+  return q.DeduplicationWindow
 }
 
 // Return up to 'count' messages from queue and leases them
-func (q *Queue) LeaseMessages(count int, timeout time.Duration) (*[]MessageInfo, error) {
+// Messages are returned in the order defined by the queue ordering
+// Messages that were already leased MaxAttempts times are moved to the
+// dead-letter queue instead
+// Only messages that have all the attributes in 'filter' are leased if it
+// isn't empty
+// Only the oldest message of each message group can be leased, so at most one
+// message per group is in flight and groups are processed in enqueue order
+func (q *Queue) LeaseMessages(count int, timeout time.Duration, filter map[string]string) (*[]MessageInfo, error) {
   now := time.Now().UTC()
-  messages, err := Mongo.FindAndUpdateMessages(bson.M{"project": q.ProjectID, "queue": q.ID, "lease_expires_at": bson.M{"$lt": now}},
-    bson.M{"$set": bson.M{"lease_expires_at": now.Add(timeout)}}, "-created_at", count)
+  if q.MaxAttempts > 0 {
+    if err := q.deadLetterMessages(now); err != nil {
+      log.Printf("**ERROR: Failed to dead-letter messages from queue %v: %v", q.Name, err)
+    }
+  }
+  messages, err := Storage.LeaseMessages(q, count, filter, now, now.Add(timeout))
   if err != nil {
     return nil, err
   }
   return messageInfos(messages)
 }
 
+// Longest time WaitMessages waits before looking for messages again
+const waitPollInterval = time.Second
+
+// Same as LeaseMessages but wait up to 'wait' for messages to become
+// available if there are none
+// Waiting consumers are woken up when messages are added to the queue and
+// poll the queue at least every second to pick up messages that become
+// available otherwise (delays and leases expiring or messages added by another
+// process sharing the store)
+// Stop waiting and return no message as soon as 'cancel' is closed (e.g. when
+// the client waiting for messages disconnects), 'cancel' may be nil
+func (q *Queue) WaitMessages(count int, timeout, wait time.Duration, filter map[string]string, cancel <-chan struct{}) (*[]MessageInfo, error) {
+  c := subscribe(q.ID)
+  defer unsubscribe(q.ID, c)
+  timer := time.NewTimer(wait)
+  defer timer.Stop()
+  poll := wait
+  if poll > waitPollInterval {
+    poll = waitPollInterval
+  }
+  for {
+    infos, err := q.LeaseMessages(count, timeout, filter)
+    if err != nil || len(*infos) > 0 {
+      return infos, err
+    }
+    select {
+    case <-c:
+    case <-time.After(poll):
+    case <-timer.C:
+      return infos, nil
+    case <-cancel:
+      return infos, nil
+    }
+  }
+}
+
+// Extend lease of message with given id so that it expires 'timeout' from now
+// 'receipt' must be the receipt handed out when the message was leased
+// Return ErrLeaseExpired if the message lease has already expired and
+// ErrInvalidReceipt if the message was leased again since
+func (q *Queue) TouchMessage(id, receipt string, timeout time.Duration) (*MessageInfo, error) {
+  if !bson.IsObjectIdHex(id) {
+    return nil, ErrNotFound
+  }
+  if receipt == "" {
+    return nil, ErrInvalidReceipt
+  }
+  now := time.Now().UTC()
+  m, err := Storage.ExtendLease(q, bson.ObjectIdHex(id), receipt, now, now.Add(timeout))
+  if err == ErrNotFound {
+    err = q.receiptError(id, receipt)
+  }
+  if err != nil {
+    return nil, err
+  }
+  infos, err := messageInfos(&[]*Message{m})
+  if err != nil {
+    return nil, err
+  }
+  return &(*infos)[0], nil
+}
+
+// Move messages that were leased MaxAttempts times and whose lease expired to
+// the dead-letter queue
+func (q *Queue) deadLetterMessages(now time.Time) error {
+  p, err := Storage.LoadProjectId(q.ProjectID)
+  if err != nil {
+    return err
+  }
+  dlq, err := p.Queue(q.DeadLetterQueue)
+  if err != nil {
+    return errors.New(fmt.Sprintf("Dead-letter queue '%v' not found", q.DeadLetterQueue))
+  }
+  count, err := Storage.DeadLetterMessages(q, dlq, now)
+  if count > 0 {
+    log.Printf("Moved %v messages from queue %v to dead-letter queue %v", count, q.Name, dlq.Name)
+  }
+  return err
+}
+
+// Move up to 'count' dead-lettered messages back to the queues they came from
+// Queue must be the dead-letter queue of at least one queue in the project
+// Return number of moved messages
+func (q *Queue) RedriveMessages(count int) (int, error) {
+  p, err := Storage.LoadProjectId(q.ProjectID)
+  if err != nil {
+    return 0, err
+  }
+  qs, err := p.Queues()
+  if err != nil {
+    return 0, err
+  }
+  total := 0
+  for _, source := range *qs {
+    if source.DeadLetterQueue != q.Name || total >= count {
+      continue
+    }
+    moved, err := Storage.RedriveMessages(q, &source, time.Now().UTC(), count - total)
+    total += moved
+    if moved > 0 {
+      notify(source.ID)
+    }
+    if err != nil {
+      return total, err
+    }
+  }
+  return total, nil
+}
+
 // Delete all messages from queue
 func (q *Queue) Clear() error {
-  count, err := Mongo.Destroy("message", bson.M{"project": q.ProjectID, "queue": q.ID})
+  count, err := Storage.ClearMessages(q)
   log.Printf("Deleted %v messages from queue %v", count, q.ID.Hex())
   return err
 }
 
+// Delete up to 'max' expired messages from queue
+// Deleted messages are added to the queue expired count
+// Expired deduplication records are also deleted
+// Return number of deleted messages
+func (q *Queue) PurgeExpiredMessages(max int) (int, error) {
+  now := time.Now().UTC()
+  if _, err := Storage.DestroyExpiredDeduplications(q, now, max); err != nil {
+    return 0, err
+  }
+  return Storage.DestroyExpiredMessages(q, now, max)
+}
+
+// Delete expired messages from all queues of all projects
+// At most 'batchSize' messages are deleted from each queue
+// Return total number of deleted messages
+func PurgeExpiredMessages(batchSize int) (int, error) {
+  ps, err := ListProjects()
+  if err != nil {
+    return 0, err
+  }
+  total := 0
+  for _, p := range *ps {
+    qs, err := p.Queues()
+    if err != nil {
+      return total, err
+    }
+    for _, q := range *qs {
+      count, err := q.PurgeExpiredMessages(batchSize)
+      total += count
+      if err != nil {
+        return total, err
+      }
+    }
+  }
+  return total, nil
+}
+
 // Delete given messages by id
-// Make sure messages belong to queue first
-func (q *Queue) DeleteMessages(messageIds *[]string) error {
-  for _, id := range *messageIds {
-    m, err := LoadMessage(id)
+// 'receipts' contains the receipts handed out when the messages were leased,
+// in the same order as 'messageIds'
+// Messages that were leased again since cannot be deleted and cause
+// ErrInvalidReceipt to be returned
+func (q *Queue) DeleteMessages(messageIds, receipts *[]string) error {
+  if len(*messageIds) != len(*receipts) {
+    return errors.New(fmt.Sprintf("Got %v message ids but %v receipts", len(*messageIds), len(*receipts)))
+  }
+  for i, id := range *messageIds {
+    receipt := (*receipts)[i]
+    if !bson.IsObjectIdHex(id) {
+      return ErrNotFound
+    }
+    if receipt == "" {
+      return ErrInvalidReceipt
+    }
+    err := Storage.DestroyLeasedMessage(q, bson.ObjectIdHex(id), receipt)
+    if err == ErrNotFound {
+      err = q.receiptError(id, receipt)
+    }
     if err != nil {
       return err
     }
-    if m.QueueID != q.ID {
-      return errors.New(fmt.Sprintf("Message with id %v does not belong to queue %v", id, q.Name))
+  }
+  return nil
+}
+
+// Put given leased messages back in queue so they can be leased again once
+// 'delay' has elapsed
+// 'receipts' contains the receipts handed out when the messages were leased,
+// in the same order as 'messageIds'
+// Return ErrLeaseExpired if a message lease has already expired and
+// ErrInvalidReceipt if a message was leased again since
+func (q *Queue) ReleaseMessages(messageIds, receipts *[]string, delay time.Duration) error {
+  if len(*messageIds) != len(*receipts) {
+    return errors.New(fmt.Sprintf("Got %v message ids but %v receipts", len(*messageIds), len(*receipts)))
+  }
+  now := time.Now().UTC()
+  var visibleAt time.Time
+  if delay > 0 {
+    visibleAt = now.Add(delay)
+  }
+  for i, id := range *messageIds {
+    receipt := (*receipts)[i]
+    if !bson.IsObjectIdHex(id) {
+      return ErrNotFound
+    }
+    if receipt == "" {
+      return ErrInvalidReceipt
+    }
+    err := Storage.ReleaseMessage(q, bson.ObjectIdHex(id), receipt, now, visibleAt)
+    if err == ErrNotFound {
+      err = q.receiptError(id, receipt)
     }
-    m.Destroy()
+    if err != nil {
+      return err
+    }
+  }
+  if delay <= 0 && len(*messageIds) > 0 {
+    notify(q.ID)
   }
   return nil
 }
 
+// Explain why operation on message with given id and receipt did not find it
+// Return ErrNotFound if message is not in queue, ErrInvalidReceipt if it was
+// leased again and ErrLeaseExpired otherwise
+func (q *Queue) receiptError(id, receipt string) error {
+  m, err := LoadMessage(id)
+  if err != nil {
+    return err
+  }
+  if m.QueueID != q.ID {
+    return ErrNotFound
+  }
+  if m.Receipt != receipt {
+    return ErrInvalidReceipt
+  }
+  return ErrLeaseExpired
+}
+
 // Retrieve messages information
 // Bulk operation
 // IMPORTANT: All messages must be from the same queue!
@@ -116,19 +518,21 @@ func messageInfos(messages *[]*Message) (*[]MessageInfo, error) {
     res := make([]MessageInfo, 0)
     return &res, nil
   }
-  p := new(Project)
-  err := Mongo.GetId("project", msgs[0].ProjectID, p)
+  p, err := Storage.LoadProjectId(msgs[0].ProjectID)
   if err != nil {
     return nil, err
   }
-  q := new(Queue)
-  err = Mongo.GetId("queue", msgs[0].QueueID, q)
+  q, err := Storage.LoadQueueId(msgs[0].QueueID)
   if err != nil {
     return nil, err
   }
   infos := make([]MessageInfo, 0, len(msgs))
   for _, m := range msgs {
-    infos = append(infos, MessageInfo{ID: m.ID, Body: m.Body, QueueName: q.Name, ProjectName: p.Name, CreatedAt: m.CreatedAt, MessageExpiresAt: m.ExpiresAt, LeaseExpiresAt: m.LeaseExpiresAt})
+    body, encoding := string(m.Body), ""
+    if m.Binary {
+      body, encoding = base64.StdEncoding.EncodeToString(m.Body), "base64"
+    }
+    infos = append(infos, MessageInfo{ID: m.ID, Body: body, Encoding: encoding, QueueName: q.Name, ProjectName: p.Name, CreatedAt: m.CreatedAt, MessageExpiresAt: m.ExpiresAt, LeaseExpiresAt: m.LeaseExpiresAt, Priority: m.Priority, Attempts: m.Attempts, Receipt: m.Receipt, Attributes: m.Attributes, GroupID: m.GroupID})
   }
   return &infos, nil
 }
@@ -0,0 +1,930 @@
+package gotcha
+
+/*
+  This file implements the Store interface on top of a SQL database
+
+  Supported drivers are "sqlite3" (github.com/mattn/go-sqlite3) and "postgres"
+  (github.com/lib/pq), the driver package must be imported by the program.
+  SQLite must be version 3.35 or later as leases rely on UPDATE ... RETURNING.
+  The schema is created (or migrated) when the store is started.
+
+  Usage:
+    import _ "github.com/mattn/go-sqlite3"
+    StartSQL("sqlite3", "/var/lib/gotcha/gotcha.sqlite")
+    ...
+    Storage.Close()
+
+  Timestamps are stored as nanoseconds since epoch (0 for zero values), ids
+  as hex encoded ObjectIds, maps and lists as JSON and binary message bodies
+  base64 encoded so that the same schema works with all drivers.
+*/
+
+import (
+  "database/sql"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "labix.org/v2/mgo/bson"
+  "log"
+  "math"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Schema migrations, applied in order at startup
+// Never modify existing entries, append new ones instead
+var sqlMigrations = []string{
+  `CREATE TABLE project (
+    id         VARCHAR(24) PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL UNIQUE,
+    created_at BIGINT NOT NULL
+  )`,
+  `CREATE TABLE queue (
+    id         VARCHAR(24) PRIMARY KEY,
+    project    VARCHAR(24) NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    created_at BIGINT NOT NULL,
+    UNIQUE (project, name)
+  )`,
+  `CREATE TABLE message (
+    id               VARCHAR(24) PRIMARY KEY,
+    project          VARCHAR(24) NOT NULL,
+    queue            VARCHAR(24) NOT NULL,
+    body             TEXT NOT NULL,
+    expires_at       BIGINT NOT NULL,
+    created_at       BIGINT NOT NULL,
+    lease_expires_at BIGINT NOT NULL
+  )`,
+  `CREATE INDEX message_lease ON message (project, queue, lease_expires_at)`,
+  `CREATE INDEX message_created_at ON message (created_at)`,
+  `CREATE INDEX message_expires_at ON message (project, queue, expires_at)`,
+  `ALTER TABLE queue ADD COLUMN expired_count BIGINT NOT NULL DEFAULT 0`,
+  `ALTER TABLE queue ADD COLUMN ordering VARCHAR(16) NOT NULL DEFAULT 'fifo'`,
+  `ALTER TABLE message ADD COLUMN priority INTEGER NOT NULL DEFAULT 0`,
+  `CREATE INDEX message_priority_lease ON message (project, queue, priority, lease_expires_at)`,
+  `ALTER TABLE message ADD COLUMN visible_at BIGINT NOT NULL DEFAULT 0`,
+  `ALTER TABLE message ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0`,
+  `ALTER TABLE message ADD COLUMN origin_queue VARCHAR(24) NOT NULL DEFAULT ''`,
+  `ALTER TABLE queue ADD COLUMN max_attempts INTEGER NOT NULL DEFAULT 0`,
+  `ALTER TABLE queue ADD COLUMN dead_letter_queue VARCHAR(255) NOT NULL DEFAULT ''`,
+  `ALTER TABLE message ADD COLUMN receipt VARCHAR(64) NOT NULL DEFAULT ''`,
+  `CREATE TABLE subscriber (
+    id              VARCHAR(24) PRIMARY KEY,
+    project         VARCHAR(24) NOT NULL,
+    queue           VARCHAR(24) NOT NULL,
+    name            VARCHAR(255) NOT NULL,
+    created_at      BIGINT NOT NULL,
+    url             TEXT NOT NULL,
+    timeout         BIGINT NOT NULL,
+    retry_delay     BIGINT NOT NULL,
+    max_retry_delay BIGINT NOT NULL,
+    UNIQUE (queue, name)
+  )`,
+  `CREATE TABLE topic (
+    id         VARCHAR(24) PRIMARY KEY,
+    project    VARCHAR(24) NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    created_at BIGINT NOT NULL,
+    UNIQUE (project, name)
+  )`,
+  `CREATE TABLE subscription (
+    id         VARCHAR(24) PRIMARY KEY,
+    project    VARCHAR(24) NOT NULL,
+    topic      VARCHAR(24) NOT NULL,
+    queue      VARCHAR(24) NOT NULL,
+    created_at BIGINT NOT NULL,
+    filter     TEXT NOT NULL,
+    UNIQUE (topic, queue)
+  )`,
+  `ALTER TABLE message ADD COLUMN attributes TEXT NOT NULL DEFAULT ''`,
+  `ALTER TABLE message ADD COLUMN body_encoding VARCHAR(16) NOT NULL DEFAULT ''`,
+  `ALTER TABLE queue ADD COLUMN deduplication_window BIGINT NOT NULL DEFAULT 0`,
+  `CREATE TABLE deduplication (
+    id               VARCHAR(24) PRIMARY KEY,
+    queue            VARCHAR(24) NOT NULL,
+    deduplication_id VARCHAR(255) NOT NULL,
+    message          VARCHAR(24) NOT NULL,
+    expires_at       BIGINT NOT NULL,
+    UNIQUE (queue, deduplication_id)
+  )`,
+  `ALTER TABLE message ADD COLUMN group_id VARCHAR(255) NOT NULL DEFAULT ''`,
+  `CREATE INDEX message_group ON message (project, queue, group_id, created_at)`,
+  `CREATE TABLE token (
+    id         VARCHAR(24) PRIMARY KEY,
+    project    VARCHAR(24) NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    hash       VARCHAR(64) NOT NULL UNIQUE,
+    created_at BIGINT NOT NULL,
+    UNIQUE (project, name)
+  )`,
+  `ALTER TABLE token ADD COLUMN scopes TEXT NOT NULL DEFAULT ''`,
+  `ALTER TABLE token ADD COLUMN queues TEXT NOT NULL DEFAULT ''`,
+  `ALTER TABLE token ADD COLUMN signing_secret TEXT NOT NULL DEFAULT ''`,
+}
+
+// Columns of queue table in the order expected by scanQueue
+const sqlQueueColumns = "id, project, name, created_at, expired_count, ordering, max_attempts, dead_letter_queue, deduplication_window"
+
+// Columns of subscription table in the order expected by scanSubscription
+const sqlSubscriptionColumns = "id, project, topic, queue, created_at, filter"
+
+// Columns of subscriber table in the order expected by scanSubscriber
+const sqlSubscriberColumns = "id, project, queue, name, created_at, url, timeout, retry_delay, max_retry_delay"
+
+// Columns of token table in the order expected by scanToken
+const sqlTokenColumns = "id, project, name, hash, created_at, scopes, queues, signing_secret"
+
+// Columns of message table in the order expected by scanMessage
+const sqlMessageColumns = "id, project, queue, body, expires_at, created_at, lease_expires_at, priority, visible_at, attempts, origin_queue, receipt, attributes, body_encoding, group_id"
+
+// SQL database backed storage
+type sqlStore struct {
+  db      *sql.DB
+  dialect string // Driver name, used to adapt queries
+}
+
+// Connect to database and use it as storage
+// Create or migrate schema as needed
+func StartSQL(driver, source string) error {
+  if driver != "sqlite3" && driver != "postgres" {
+    return errors.New(fmt.Sprintf("Unsupported SQL driver '%v'", driver))
+  }
+  db, err := sql.Open(driver, source)
+  if err != nil {
+    log.Printf("**ERROR: Could not open %v database: %v", driver, err)
+    return err
+  }
+  if driver == "sqlite3" {
+    // SQLite does not support concurrent writers
+    db.SetMaxOpenConns(1)
+  }
+  s := &sqlStore{db: db, dialect: driver}
+  if err := s.migrate(); err != nil {
+    log.Printf("**ERROR: Could not migrate %v database schema: %v", driver, err)
+    db.Close()
+    return err
+  }
+  Storage = s
+  return nil
+}
+
+// Apply schema migrations that have not been applied yet
+func (s *sqlStore) migrate() error {
+  if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+    return err
+  }
+  var version int
+  if err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+    return err
+  }
+  for i := version; i < len(sqlMigrations); i++ {
+    tx, err := s.db.Begin()
+    if err != nil {
+      return err
+    }
+    if _, err := tx.Exec(sqlMigrations[i]); err != nil {
+      tx.Rollback()
+      return err
+    }
+    if _, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), i+1); err != nil {
+      tx.Rollback()
+      return err
+    }
+    if err := tx.Commit(); err != nil {
+      return err
+    }
+    log.Printf("Applied %v schema migration %v", s.dialect, i+1)
+  }
+  return nil
+}
+
+// Close database connections
+func (s *sqlStore) Close() {
+  s.db.Close()
+}
+
+// List all projects
+func (s *sqlStore) ListProjects() (*[]Project, error) {
+  ps := make([]Project, 0, 10)
+  rows, err := s.query("SELECT id, name, created_at FROM project")
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    p, err := scanProject(rows)
+    if err != nil {
+      return nil, err
+    }
+    ps = append(ps, *p)
+  }
+  return &ps, rows.Err()
+}
+
+// Save new project
+func (s *sqlStore) InsertProject(p *Project) error {
+  _, err := s.exec("INSERT INTO project (id, name, created_at) VALUES (?, ?, ?)", p.ID.Hex(), p.Name, sqlTime(p.CreatedAt))
+  return err
+}
+
+// Load project with given name
+func (s *sqlStore) LoadProject(name string) (*Project, error) {
+  return scanProject(s.queryRow("SELECT id, name, created_at FROM project WHERE name = ?", name))
+}
+
+// Load project with given id
+func (s *sqlStore) LoadProjectId(id bson.ObjectId) (*Project, error) {
+  return scanProject(s.queryRow("SELECT id, name, created_at FROM project WHERE id = ?", id.Hex()))
+}
+
+// Delete project
+func (s *sqlStore) DestroyProject(p *Project) error {
+  return s.execOne("DELETE FROM project WHERE id = ?", p.ID.Hex())
+}
+
+// List all queues in project
+func (s *sqlStore) ListQueues(p *Project) (*[]Queue, error) {
+  qs := make([]Queue, 0)
+  rows, err := s.query("SELECT "+sqlQueueColumns+" FROM queue WHERE project = ?", p.ID.Hex())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    q, err := scanQueue(rows)
+    if err != nil {
+      return nil, err
+    }
+    qs = append(qs, *q)
+  }
+  return &qs, rows.Err()
+}
+
+// Number of queues in project
+func (s *sqlStore) CountQueues(p *Project) (int, error) {
+  var count int
+  err := s.queryRow("SELECT COUNT(*) FROM queue WHERE project = ?", p.ID.Hex()).Scan(&count)
+  return count, err
+}
+
+// Save new queue
+func (s *sqlStore) InsertQueue(q *Queue) error {
+  _, err := s.exec("INSERT INTO queue (id, project, name, created_at, ordering, max_attempts, dead_letter_queue, deduplication_window) "+
+    "VALUES (?, ?, ?, ?, ?, ?, ?, ?)", q.ID.Hex(), q.ProjectID.Hex(), q.Name, sqlTime(q.CreatedAt), q.ordering(), q.MaxAttempts,
+    q.DeadLetterQueue, int64(q.DeduplicationWindow))
+  return err
+}
+
+// Load queue with given name from project
+func (s *sqlStore) LoadQueue(p *Project, name string) (*Queue, error) {
+  return scanQueue(s.queryRow("SELECT "+sqlQueueColumns+" FROM queue WHERE project = ? AND name = ?", p.ID.Hex(), name))
+}
+
+// Load queue with given id
+func (s *sqlStore) LoadQueueId(id bson.ObjectId) (*Queue, error) {
+  return scanQueue(s.queryRow("SELECT "+sqlQueueColumns+" FROM queue WHERE id = ?", id.Hex()))
+}
+
+// Delete queue
+func (s *sqlStore) DestroyQueue(q *Queue) error {
+  return s.execOne("DELETE FROM queue WHERE id = ?", q.ID.Hex())
+}
+
+// List all topics in project
+func (s *sqlStore) ListTopics(p *Project) (*[]Topic, error) {
+  ts := make([]Topic, 0)
+  rows, err := s.query("SELECT id, project, name, created_at FROM topic WHERE project = ?", p.ID.Hex())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    t, err := scanTopic(rows)
+    if err != nil {
+      return nil, err
+    }
+    ts = append(ts, *t)
+  }
+  return &ts, rows.Err()
+}
+
+// Save new topic
+func (s *sqlStore) InsertTopic(t *Topic) error {
+  _, err := s.exec("INSERT INTO topic (id, project, name, created_at) VALUES (?, ?, ?, ?)",
+    t.ID.Hex(), t.ProjectID.Hex(), t.Name, sqlTime(t.CreatedAt))
+  return err
+}
+
+// Load topic with given name from project
+func (s *sqlStore) LoadTopic(p *Project, name string) (*Topic, error) {
+  return scanTopic(s.queryRow("SELECT id, project, name, created_at FROM topic WHERE project = ? AND name = ?", p.ID.Hex(), name))
+}
+
+// Delete topic
+func (s *sqlStore) DestroyTopic(t *Topic) error {
+  return s.execOne("DELETE FROM topic WHERE id = ?", t.ID.Hex())
+}
+
+// List all subscriptions of topic
+func (s *sqlStore) ListSubscriptions(t *Topic) (*[]Subscription, error) {
+  subs := make([]Subscription, 0)
+  rows, err := s.query("SELECT "+sqlSubscriptionColumns+" FROM subscription WHERE topic = ?", t.ID.Hex())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    sub, err := scanSubscription(rows)
+    if err != nil {
+      return nil, err
+    }
+    subs = append(subs, *sub)
+  }
+  return &subs, rows.Err()
+}
+
+// Save new subscription
+func (s *sqlStore) InsertSubscription(sub *Subscription) error {
+  _, err := s.exec("INSERT INTO subscription ("+sqlSubscriptionColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+    sub.ID.Hex(), sub.ProjectID.Hex(), sub.TopicID.Hex(), sub.QueueID.Hex(), sqlTime(sub.CreatedAt), sqlMap(sub.Filter))
+  return err
+}
+
+// Load subscription of given queue to topic
+func (s *sqlStore) LoadSubscription(t *Topic, q *Queue) (*Subscription, error) {
+  return scanSubscription(s.queryRow("SELECT "+sqlSubscriptionColumns+" FROM subscription WHERE topic = ? AND queue = ?",
+    t.ID.Hex(), q.ID.Hex()))
+}
+
+// Delete subscription
+func (s *sqlStore) DestroySubscription(sub *Subscription) error {
+  return s.execOne("DELETE FROM subscription WHERE id = ?", sub.ID.Hex())
+}
+
+// List all subscribers of queue
+func (s *sqlStore) ListSubscribers(q *Queue) (*[]Subscriber, error) {
+  subs := make([]Subscriber, 0)
+  rows, err := s.query("SELECT "+sqlSubscriberColumns+" FROM subscriber WHERE queue = ?", q.ID.Hex())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    sub, err := scanSubscriber(rows)
+    if err != nil {
+      return nil, err
+    }
+    subs = append(subs, *sub)
+  }
+  return &subs, rows.Err()
+}
+
+// Save new subscriber
+func (s *sqlStore) InsertSubscriber(sub *Subscriber) error {
+  _, err := s.exec("INSERT INTO subscriber ("+sqlSubscriberColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+    sub.ID.Hex(), sub.ProjectID.Hex(), sub.QueueID.Hex(), sub.Name, sqlTime(sub.CreatedAt), sub.URL, int64(sub.Timeout),
+    int64(sub.RetryDelay), int64(sub.MaxRetryDelay))
+  return err
+}
+
+// Load subscriber with given name from queue
+func (s *sqlStore) LoadSubscriber(q *Queue, name string) (*Subscriber, error) {
+  return scanSubscriber(s.queryRow("SELECT "+sqlSubscriberColumns+" FROM subscriber WHERE queue = ? AND name = ?", q.ID.Hex(), name))
+}
+
+// Delete subscriber
+func (s *sqlStore) DestroySubscriber(sub *Subscriber) error {
+  return s.execOne("DELETE FROM subscriber WHERE id = ?", sub.ID.Hex())
+}
+
+// List all tokens of project
+func (s *sqlStore) ListTokens(p *Project) (*[]Token, error) {
+  ts := make([]Token, 0)
+  rows, err := s.query("SELECT "+sqlTokenColumns+" FROM token WHERE project = ?", p.ID.Hex())
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    t, err := scanToken(rows)
+    if err != nil {
+      return nil, err
+    }
+    ts = append(ts, *t)
+  }
+  return &ts, rows.Err()
+}
+
+// Save new token
+func (s *sqlStore) InsertToken(t *Token) error {
+  _, err := s.exec("INSERT INTO token ("+sqlTokenColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+    t.ID.Hex(), t.ProjectID.Hex(), t.Name, t.Hash, sqlTime(t.CreatedAt), sqlList(t.Scopes), sqlList(t.Queues), t.SigningSecret)
+  return err
+}
+
+// Load token with given name from project
+func (s *sqlStore) LoadToken(p *Project, name string) (*Token, error) {
+  return scanToken(s.queryRow("SELECT "+sqlTokenColumns+" FROM token WHERE project = ? AND name = ?", p.ID.Hex(), name))
+}
+
+// Load token with given secret hash
+func (s *sqlStore) LoadTokenHash(hash string) (*Token, error) {
+  return scanToken(s.queryRow("SELECT "+sqlTokenColumns+" FROM token WHERE hash = ?", hash))
+}
+
+// Delete token
+func (s *sqlStore) DestroyToken(t *Token) error {
+  return s.execOne("DELETE FROM token WHERE id = ?", t.ID.Hex())
+}
+
+// Save new messages in a single transaction
+func (s *sqlStore) InsertMessages(messages *[]*Message) error {
+  tx, err := s.db.Begin()
+  if err != nil {
+    return err
+  }
+  stmt, err := tx.Prepare(s.rebind("INSERT INTO message (" + sqlMessageColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+  if err != nil {
+    tx.Rollback()
+    return err
+  }
+  defer stmt.Close()
+  for _, m := range *messages {
+    body, encoding := string(m.Body), ""
+    if m.Binary {
+      body, encoding = base64.StdEncoding.EncodeToString(m.Body), "base64"
+    }
+    _, err := stmt.Exec(m.ID.Hex(), m.ProjectID.Hex(), m.QueueID.Hex(), body, sqlTime(m.ExpiresAt), sqlTime(m.CreatedAt), sqlTime(m.LeaseExpiresAt), m.Priority, sqlTime(m.VisibleAt),
+      m.Attempts, sqlId(m.OriginQueueID), m.Receipt, sqlMap(m.Attributes), encoding, m.GroupID)
+    if err != nil {
+      log.Printf("**ERROR: Could not insert message %v: %v", m.ID.Hex(), err)
+      tx.Rollback()
+      return err
+    }
+  }
+  return tx.Commit()
+}
+
+// Load message with given id, expired messages are not returned
+func (s *sqlStore) LoadMessage(id bson.ObjectId) (*Message, error) {
+  return scanMessage(s.queryRow("SELECT "+sqlMessageColumns+" FROM message WHERE id = ? AND expires_at >= ?", id.Hex(), sqlTime(time.Now())))
+}
+
+// Delete message
+func (s *sqlStore) DestroyMessage(m *Message) error {
+  return s.execOne("DELETE FROM message WHERE id = ?", m.ID.Hex())
+}
+
+// Counts of unexpired messages in queue
+func (s *sqlStore) QueueStats(q *Queue, now time.Time) (*QueueStats, error) {
+  rows, err := s.query("SELECT priority, COUNT(*), "+
+    "SUM(CASE WHEN visible_at <= ? AND lease_expires_at < ? THEN 1 ELSE 0 END), "+
+    "SUM(CASE WHEN visible_at > ? THEN 1 ELSE 0 END) "+
+    "FROM message WHERE project = ? AND queue = ? AND expires_at >= ? GROUP BY priority",
+    sqlTime(now), sqlTime(now), sqlTime(now), q.ProjectID.Hex(), q.ID.Hex(), sqlTime(now))
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  stats := newQueueStats()
+  for rows.Next() {
+    var priority, count, ready, delayed int
+    if err := rows.Scan(&priority, &count, &ready, &delayed); err != nil {
+      return nil, err
+    }
+    stats.Size += count
+    stats.Ready += ready
+    stats.Delayed += delayed
+    stats.Priorities[priority] += count
+  }
+  if err := rows.Err(); err != nil {
+    return nil, err
+  }
+  err = s.queryRow("SELECT COUNT(DISTINCT group_id) FROM message WHERE project = ? AND queue = ? AND expires_at >= ? AND group_id <> ''",
+    q.ProjectID.Hex(), q.ID.Hex(), sqlTime(now)).Scan(&stats.Groups)
+  return stats, err
+}
+
+// Delete all messages from queue
+func (s *sqlStore) ClearMessages(q *Queue) (int, error) {
+  res, err := s.exec("DELETE FROM message WHERE project = ? AND queue = ?", q.ProjectID.Hex(), q.ID.Hex())
+  if err != nil {
+    return 0, err
+  }
+  count, err := res.RowsAffected()
+  return int(count), err
+}
+
+// Lease messages whose lease expired in queue order
+// All messages are selected and leased in a single statement, PostgreSQL
+// skips rows locked by concurrent leases, SQLite serializes writes
+// Attributes are filtered by looking for each JSON encoded "name":"value"
+// pair in the attributes column, this cannot match inside another value as
+// quotes are escaped there
+// Grouped messages are skipped when an older unexpired message of their group
+// exists as that message is either leased, delayed or leased first
+func (s *sqlStore) LeaseMessages(q *Queue, count int, filter map[string]string, now, until time.Time) (*[]*Message, error) {
+  lock, find := "", "instr(attributes, ?) > 0"
+  if s.dialect == "postgres" {
+    lock, find = " FOR UPDATE SKIP LOCKED", "strpos(attributes, ?) > 0"
+  }
+  maxAttempts := q.MaxAttempts
+  if maxAttempts == 0 {
+    maxAttempts = math.MaxInt32
+  }
+  // Receipts are made unique per message by appending the message id to a random prefix
+  args := []interface{}{sqlTime(until), newReceipt(), q.ProjectID.Hex(), q.ID.Hex(), sqlTime(now), sqlTime(now), maxAttempts}
+  attrs := ""
+  for k, v := range filter {
+    pair := sqlMap(map[string]string{k: v})
+    attrs += " AND " + find
+    args = append(args, pair[1:len(pair)-1])
+  }
+  args = append(args, sqlTime(now), count)
+  // UPDATE ... RETURNING requires SQLite 3.35 or later (PostgreSQL 8.2 or later)
+  rows, err := s.query("UPDATE message SET lease_expires_at = ?, attempts = attempts + 1, receipt = ? || id WHERE id IN ("+
+    "SELECT id FROM message m WHERE project = ? AND queue = ? AND lease_expires_at < ? AND expires_at >= ? AND attempts < ?"+attrs+
+    " AND (m.group_id = '' OR NOT EXISTS (SELECT 1 FROM message e WHERE e.project = m.project AND e.queue = m.queue"+
+    " AND e.group_id = m.group_id AND e.expires_at >= ? AND (e.created_at < m.created_at OR (e.created_at = m.created_at AND e.id < m.id))))"+
+    " ORDER BY "+sqlOrderBy(q.ordering())+" LIMIT ?"+lock+") RETURNING "+sqlMessageColumns, args...)
+  if err != nil {
+    return nil, err
+  }
+  defer rows.Close()
+  res := make([]*Message, 0, count)
+  for rows.Next() {
+    m, err := scanMessage(rows)
+    if err != nil {
+      return nil, err
+    }
+    res = append(res, m)
+  }
+  if err := rows.Err(); err != nil {
+    return nil, err
+  }
+  // RETURNING does not preserve the sub-query order
+  sortMessages(res, q.ordering())
+  return &res, nil
+}
+
+// Extend lease of leased message
+func (s *sqlStore) ExtendLease(q *Queue, id bson.ObjectId, receipt string, now, until time.Time) (*Message, error) {
+  return scanMessage(s.queryRow("UPDATE message SET lease_expires_at = ? "+
+    "WHERE id = ? AND queue = ? AND receipt = ? AND lease_expires_at >= ? AND visible_at <= ? AND expires_at >= ? RETURNING "+
+    sqlMessageColumns, sqlTime(until), id.Hex(), q.ID.Hex(), receipt, sqlTime(now), sqlTime(now), sqlTime(now)))
+}
+
+// Release leased message
+func (s *sqlStore) ReleaseMessage(q *Queue, id bson.ObjectId, receipt string, now, visibleAt time.Time) error {
+  return s.execOne("UPDATE message SET lease_expires_at = ?, visible_at = ?, receipt = '' "+
+    "WHERE id = ? AND queue = ? AND receipt = ? AND lease_expires_at >= ? AND visible_at <= ? AND expires_at >= ?",
+    sqlTime(visibleAt), sqlTime(visibleAt), id.Hex(), q.ID.Hex(), receipt, sqlTime(now), sqlTime(now), sqlTime(now))
+}
+
+// Delete leased message
+func (s *sqlStore) DestroyLeasedMessage(q *Queue, id bson.ObjectId, receipt string) error {
+  return s.execOne("DELETE FROM message WHERE id = ? AND queue = ? AND receipt = ?", id.Hex(), q.ID.Hex(), receipt)
+}
+
+// Move poisoned messages to dead-letter queue
+func (s *sqlStore) DeadLetterMessages(q, dlq *Queue, now time.Time) (int, error) {
+  res, err := s.exec("UPDATE message SET queue = ?, origin_queue = ?, attempts = 0 "+
+    "WHERE project = ? AND queue = ? AND lease_expires_at < ? AND expires_at >= ? AND attempts >= ?",
+    dlq.ID.Hex(), q.ID.Hex(), q.ProjectID.Hex(), q.ID.Hex(), sqlTime(now), sqlTime(now), q.MaxAttempts)
+  if err != nil {
+    return 0, err
+  }
+  count, err := res.RowsAffected()
+  return int(count), err
+}
+
+// Move dead-lettered messages back to their origin queue
+func (s *sqlStore) RedriveMessages(dlq, q *Queue, now time.Time, max int) (int, error) {
+  res, err := s.exec("UPDATE message SET queue = ?, origin_queue = '', attempts = 0 WHERE id IN ("+
+    "SELECT id FROM message WHERE project = ? AND queue = ? AND origin_queue = ? AND lease_expires_at < ? AND expires_at >= ? LIMIT ?)",
+    q.ID.Hex(), dlq.ProjectID.Hex(), dlq.ID.Hex(), q.ID.Hex(), sqlTime(now), sqlTime(now), max)
+  if err != nil {
+    return 0, err
+  }
+  count, err := res.RowsAffected()
+  return int(count), err
+}
+
+// Delete up to 'max' expired messages from queue and update its expired count
+func (s *sqlStore) DestroyExpiredMessages(q *Queue, now time.Time, max int) (int, error) {
+  tx, err := s.db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  res, err := tx.Exec(s.rebind("DELETE FROM message WHERE id IN ("+
+    "SELECT id FROM message WHERE project = ? AND queue = ? AND expires_at < ? LIMIT ?)"),
+    q.ProjectID.Hex(), q.ID.Hex(), sqlTime(now), max)
+  if err != nil {
+    tx.Rollback()
+    return 0, err
+  }
+  count, err := res.RowsAffected()
+  if err != nil {
+    tx.Rollback()
+    return 0, err
+  }
+  if count > 0 {
+    _, err = tx.Exec(s.rebind("UPDATE queue SET expired_count = expired_count + ? WHERE id = ?"), count, q.ID.Hex())
+    if err != nil {
+      tx.Rollback()
+      return 0, err
+    }
+  }
+  return int(count), tx.Commit()
+}
+
+// Save deduplication record unless an unexpired one exists for the same id
+// The upsert only replaces expired records, the unique constraint on queue
+// and deduplication id makes concurrent claims resolve to the same record
+func (s *sqlStore) ClaimDeduplication(d *Deduplication, now time.Time) (*Deduplication, error) {
+  _, err := s.exec("INSERT INTO deduplication (id, queue, deduplication_id, message, expires_at) VALUES (?, ?, ?, ?, ?) "+
+    "ON CONFLICT (queue, deduplication_id) DO UPDATE SET id = excluded.id, message = excluded.message, "+
+    "expires_at = excluded.expires_at WHERE deduplication.expires_at < ?",
+    d.ID.Hex(), d.QueueID.Hex(), d.DeduplicationID, d.MessageID.Hex(), sqlTime(d.ExpiresAt), sqlTime(now))
+  if err != nil {
+    return nil, err
+  }
+  var id, messageID string
+  var expiresAt int64
+  err = s.queryRow("SELECT id, message, expires_at FROM deduplication WHERE queue = ? AND deduplication_id = ?",
+    d.QueueID.Hex(), d.DeduplicationID).Scan(&id, &messageID, &expiresAt)
+  if err != nil {
+    return nil, sqlNotFound(err)
+  }
+  return &Deduplication{ID: bson.ObjectIdHex(id), QueueID: d.QueueID, DeduplicationID: d.DeduplicationID,
+    MessageID: bson.ObjectIdHex(messageID), ExpiresAt: fromSQLTime(expiresAt)}, nil
+}
+
+// Delete deduplication record
+func (s *sqlStore) DestroyDeduplication(d *Deduplication) error {
+  return s.execOne("DELETE FROM deduplication WHERE id = ?", d.ID.Hex())
+}
+
+// Delete up to 'max' expired deduplication records from queue
+func (s *sqlStore) DestroyExpiredDeduplications(q *Queue, now time.Time, max int) (int, error) {
+  res, err := s.exec("DELETE FROM deduplication WHERE id IN (SELECT id FROM deduplication WHERE queue = ? AND expires_at < ? LIMIT ?)",
+    q.ID.Hex(), sqlTime(now), max)
+  if err != nil {
+    return 0, err
+  }
+  count, err := res.RowsAffected()
+  return int(count), err
+}
+
+// Delete all deduplication records of queue
+func (s *sqlStore) ClearDeduplications(q *Queue) error {
+  _, err := s.exec("DELETE FROM deduplication WHERE queue = ?", q.ID.Hex())
+  return err
+}
+
+// ORDER BY clause used to lease messages given queue ordering
+func sqlOrderBy(ordering string) string {
+  switch ordering {
+  case OrderLIFO:
+    return "created_at DESC, id DESC"
+  case OrderPriority:
+    return "priority DESC, created_at, id"
+  }
+  return "created_at, id"
+}
+
+// Run query that does not return rows
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+  res, err := s.db.Exec(s.rebind(query), args...)
+  if err != nil {
+    log.Printf("**ERROR: Failed to run statement '%v': %v", query, err)
+  }
+  return res, err
+}
+
+// Run statement that must affect at least one row, return ErrNotFound otherwise
+func (s *sqlStore) execOne(query string, args ...interface{}) error {
+  res, err := s.exec(query, args...)
+  if err != nil {
+    return err
+  }
+  if count, err := res.RowsAffected(); err != nil {
+    return err
+  } else if count == 0 {
+    return ErrNotFound
+  }
+  return nil
+}
+
+// Run query that returns rows
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+  rows, err := s.db.Query(s.rebind(query), args...)
+  if err != nil {
+    log.Printf("**ERROR: Failed to run query '%v': %v", query, err)
+  }
+  return rows, err
+}
+
+// Run query that returns at most one row
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+  return s.db.QueryRow(s.rebind(query), args...)
+}
+
+// Replace '?' placeholders with '$n' for PostgreSQL
+func (s *sqlStore) rebind(query string) string {
+  if s.dialect != "postgres" {
+    return query
+  }
+  parts := strings.Split(query, "?")
+  res := parts[0]
+  for i, p := range parts[1:] {
+    res += "$" + strconv.Itoa(i+1) + p
+  }
+  return res
+}
+
+// Anything that can be scanned: *sql.Row or *sql.Rows
+type sqlScanner interface {
+  Scan(dest ...interface{}) error
+}
+
+// Scan project row, return ErrNotFound if there is none
+func scanProject(row sqlScanner) (*Project, error) {
+  var id string
+  var createdAt int64
+  p := new(Project)
+  if err := row.Scan(&id, &p.Name, &createdAt); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  p.ID, p.CreatedAt = bson.ObjectIdHex(id), fromSQLTime(createdAt)
+  return p, nil
+}
+
+// Scan topic row, return ErrNotFound if there is none
+func scanTopic(row sqlScanner) (*Topic, error) {
+  var id, projectID string
+  var createdAt int64
+  t := new(Topic)
+  if err := row.Scan(&id, &projectID, &t.Name, &createdAt); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  t.ID, t.ProjectID, t.CreatedAt = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), fromSQLTime(createdAt)
+  return t, nil
+}
+
+// Scan subscription row, return ErrNotFound if there is none
+func scanSubscription(row sqlScanner) (*Subscription, error) {
+  var id, projectID, topicID, queueID, filter string
+  var createdAt int64
+  sub := new(Subscription)
+  if err := row.Scan(&id, &projectID, &topicID, &queueID, &createdAt, &filter); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  sub.ID, sub.ProjectID, sub.TopicID, sub.QueueID = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), bson.ObjectIdHex(topicID), bson.ObjectIdHex(queueID)
+  sub.CreatedAt, sub.Filter = fromSQLTime(createdAt), fromSQLMap(filter)
+  return sub, nil
+}
+
+// Scan subscriber row, return ErrNotFound if there is none
+func scanSubscriber(row sqlScanner) (*Subscriber, error) {
+  var id, projectID, queueID string
+  var createdAt, timeout, retryDelay, maxRetryDelay int64
+  sub := new(Subscriber)
+  if err := row.Scan(&id, &projectID, &queueID, &sub.Name, &createdAt, &sub.URL, &timeout, &retryDelay, &maxRetryDelay); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  sub.ID, sub.ProjectID, sub.QueueID, sub.CreatedAt = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), bson.ObjectIdHex(queueID), fromSQLTime(createdAt)
+  sub.Timeout, sub.RetryDelay, sub.MaxRetryDelay = time.Duration(timeout), time.Duration(retryDelay), time.Duration(maxRetryDelay)
+  return sub, nil
+}
+
+// Scan token row (see sqlTokenColumns), return ErrNotFound if there is none
+func scanToken(row sqlScanner) (*Token, error) {
+  var id, projectID, scopes, queues string
+  var createdAt int64
+  t := new(Token)
+  if err := row.Scan(&id, &projectID, &t.Name, &t.Hash, &createdAt, &scopes, &queues, &t.SigningSecret); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  t.ID, t.ProjectID, t.CreatedAt = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), fromSQLTime(createdAt)
+  t.Scopes, t.Queues = fromSQLList(scopes), fromSQLList(queues)
+  return t, nil
+}
+
+// Scan queue row, return ErrNotFound if there is none
+func scanQueue(row sqlScanner) (*Queue, error) {
+  var id, projectID string
+  var createdAt, dedupWindow int64
+  q := new(Queue)
+  if err := row.Scan(&id, &projectID, &q.Name, &createdAt, &q.ExpiredCount, &q.Ordering, &q.MaxAttempts, &q.DeadLetterQueue,
+    &dedupWindow); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  q.ID, q.ProjectID, q.CreatedAt = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), fromSQLTime(createdAt)
+  q.DeduplicationWindow = time.Duration(dedupWindow)
+  return q, nil
+}
+
+// Scan message row (see sqlMessageColumns), return ErrNotFound if there is none
+func scanMessage(row sqlScanner) (*Message, error) {
+  var id, projectID, queueID, body, originQueueID, attributes, encoding string
+  var expiresAt, createdAt, leaseExpiresAt, visibleAt int64
+  m := new(Message)
+  if err := row.Scan(&id, &projectID, &queueID, &body, &expiresAt, &createdAt, &leaseExpiresAt, &m.Priority, &visibleAt,
+    &m.Attempts, &originQueueID, &m.Receipt, &attributes, &encoding, &m.GroupID); err != nil {
+    return nil, sqlNotFound(err)
+  }
+  if encoding == "base64" {
+    b, err := base64.StdEncoding.DecodeString(body)
+    if err != nil {
+      return nil, err
+    }
+    m.Body, m.Binary = b, true
+  } else {
+    m.Body = []byte(body)
+  }
+  m.ID, m.ProjectID, m.QueueID = bson.ObjectIdHex(id), bson.ObjectIdHex(projectID), bson.ObjectIdHex(queueID)
+  m.ExpiresAt, m.CreatedAt, m.LeaseExpiresAt = fromSQLTime(expiresAt), fromSQLTime(createdAt), fromSQLTime(leaseExpiresAt)
+  m.VisibleAt, m.OriginQueueID, m.Attributes = fromSQLTime(visibleAt), fromSQLId(originQueueID), fromSQLMap(attributes)
+  return m, nil
+}
+
+// Translate sql "no rows" error into storage agnostic error
+func sqlNotFound(err error) error {
+  if err == sql.ErrNoRows {
+    return ErrNotFound
+  }
+  return err
+}
+
+// Convert optional id to database value
+func sqlId(id bson.ObjectId) string {
+  if id == "" {
+    return ""
+  }
+  return id.Hex()
+}
+
+// Convert database value to optional id
+func fromSQLId(hex string) bson.ObjectId {
+  if hex == "" {
+    return ""
+  }
+  return bson.ObjectIdHex(hex)
+}
+
+// Convert optional map to database value
+func sqlMap(m map[string]string) string {
+  if len(m) == 0 {
+    return ""
+  }
+  b, _ := json.Marshal(m)
+  return string(b)
+}
+
+// Convert database value to optional map
+func fromSQLMap(s string) map[string]string {
+  if s == "" {
+    return nil
+  }
+  m := make(map[string]string)
+  json.Unmarshal([]byte(s), &m)
+  return m
+}
+
+// Convert optional list to database value
+func sqlList(l []string) string {
+  if len(l) == 0 {
+    return ""
+  }
+  b, _ := json.Marshal(l)
+  return string(b)
+}
+
+// Convert database value to optional list
+func fromSQLList(s string) []string {
+  if s == "" {
+    return nil
+  }
+  l := make([]string, 0)
+  json.Unmarshal([]byte(s), &l)
+  return l
+}
+
+// Convert timestamp to database value
+func sqlTime(t time.Time) int64 {
+  if t.IsZero() {
+    return 0
+  }
+  return t.UnixNano()
+}
+
+// Convert database value to timestamp
+func fromSQLTime(n int64) time.Time {
+  if n == 0 {
+    return time.Time{}
+  }
+  return time.Unix(0, n).UTC()
+}
@@ -0,0 +1,167 @@
+package gotcha
+
+import (
+  _ "github.com/mattn/go-sqlite3"
+  "labix.org/v2/mgo/bson"
+  "testing"
+  "time"
+)
+
+// Use a new in-memory SQLite database as storage
+// SQLite connections are limited to one so all queries see the same database
+func startTestSQL(t *testing.T) *sqlStore {
+  if err := StartSQL("sqlite3", ":memory:"); err != nil {
+    t.Fatalf("Failed to start SQL store: %v", err)
+  }
+  t.Cleanup(func() { Storage.Close() })
+  return Storage.(*sqlStore)
+}
+
+// Create queue with given name and settings in project "p"
+func createTestQueue(t *testing.T, name string, settings QueueSettings) *Queue {
+  p, err := LoadProject("p")
+  if err == ErrNotFound {
+    p, err = NewProject("p")
+  }
+  if err != nil {
+    t.Fatal(err)
+  }
+  q, err := NewQueue(name, p, settings)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return q
+}
+
+// Save messages with given bodies in queue, 'setup' customizes each message
+// Messages are created one millisecond apart in the given order
+func saveTestMessages(t *testing.T, q *Queue, bodies []string, setup func(i int, m *Message)) {
+  now := time.Now().UTC().Add(-time.Minute)
+  messages := make([]*Message, 0, len(bodies))
+  for i, body := range bodies {
+    created := now.Add(time.Duration(i) * time.Millisecond)
+    m := &Message{ID: bson.NewObjectId(), Body: []byte(body), QueueID: q.ID, ProjectID: q.ProjectID,
+      CreatedAt: created, ExpiresAt: created.Add(time.Hour)}
+    if setup != nil {
+      setup(i, m)
+    }
+    messages = append(messages, m)
+  }
+  if err := SaveMessages(&messages); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// Lease up to 'count' messages from queue, return their bodies
+func leaseTestBodies(t *testing.T, q *Queue, count int, filter map[string]string) []string {
+  infos, err := q.LeaseMessages(count, time.Minute, filter)
+  if err != nil {
+    t.Fatal(err)
+  }
+  bodies := make([]string, 0, len(*infos))
+  for _, i := range *infos {
+    bodies = append(bodies, i.Body)
+  }
+  return bodies
+}
+
+// Fail test unless bodies are the expected ones in the same order
+func expectBodies(t *testing.T, bodies []string, expected ...string) {
+  t.Helper()
+  if len(bodies) != len(expected) {
+    t.Fatalf("Expected %v, got %v", expected, bodies)
+  }
+  for i := range bodies {
+    if bodies[i] != expected[i] {
+      t.Fatalf("Expected %v, got %v", expected, bodies)
+    }
+  }
+}
+
+func TestSQLMigrate(t *testing.T) {
+  s := startTestSQL(t)
+  var version int
+  if err := s.db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+    t.Fatal(err)
+  }
+  if version != len(sqlMigrations) {
+    t.Fatalf("Schema version is %v after migration, expected %v", version, len(sqlMigrations))
+  }
+  if err := s.migrate(); err != nil {
+    t.Fatalf("Migrating migrated schema failed: %v", err)
+  }
+  var count int
+  if err := s.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&count); err != nil || count != len(sqlMigrations) {
+    t.Fatalf("Migrations were applied again (%v rows, %v)", count, err)
+  }
+}
+
+func TestSQLLeaseMessagesCount(t *testing.T) {
+  startTestSQL(t)
+  q := createTestQueue(t, "q", QueueSettings{})
+  saveTestMessages(t, q, []string{"a", "b", "c", "d", "e"}, nil)
+  expectBodies(t, leaseTestBodies(t, q, 3, nil), "a", "b", "c")
+  expectBodies(t, leaseTestBodies(t, q, 3, nil), "d", "e")
+  expectBodies(t, leaseTestBodies(t, q, 3, nil))
+  infos, err := q.LeaseMessages(0, time.Minute, nil)
+  if err != nil || len(*infos) != 0 {
+    t.Fatalf("Leasing no message returned %v (%v)", infos, err)
+  }
+}
+
+func TestSQLLeaseMessagesOrdering(t *testing.T) {
+  startTestSQL(t)
+  fifo := createTestQueue(t, "fifo", QueueSettings{Ordering: OrderFIFO})
+  lifo := createTestQueue(t, "lifo", QueueSettings{Ordering: OrderLIFO})
+  prio := createTestQueue(t, "prio", QueueSettings{Ordering: OrderPriority})
+  bodies := []string{"a", "b", "c", "d"}
+  priorities := []int{1, 5, -2, 5}
+  for _, q := range []*Queue{fifo, lifo, prio} {
+    saveTestMessages(t, q, bodies, func(i int, m *Message) { m.Priority = priorities[i] })
+  }
+  expectBodies(t, leaseTestBodies(t, fifo, 10, nil), "a", "b", "c", "d")
+  expectBodies(t, leaseTestBodies(t, lifo, 10, nil), "d", "c", "b", "a")
+  expectBodies(t, leaseTestBodies(t, prio, 10, nil), "b", "d", "a", "c")
+}
+
+func TestSQLLeaseMessagesGroups(t *testing.T) {
+  startTestSQL(t)
+  q := createTestQueue(t, "q", QueueSettings{})
+  groups := []string{"g1", "", "g1", "g2", "g2"}
+  saveTestMessages(t, q, []string{"a", "b", "c", "d", "e"}, func(i int, m *Message) { m.GroupID = groups[i] })
+
+  // Only the head of each group can be leased, one at a time
+  infos, err := q.LeaseMessages(10, time.Minute, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  bodies := make([]string, 0)
+  for _, i := range *infos {
+    bodies = append(bodies, i.Body)
+  }
+  expectBodies(t, bodies, "a", "b", "d")
+  expectBodies(t, leaseTestBodies(t, q, 10, nil))
+
+  // Deleting a head makes the next message of its group leasable
+  ids, receipts := []string{(*infos)[0].ID.Hex()}, []string{(*infos)[0].Receipt}
+  if err := q.DeleteMessages(&ids, &receipts); err != nil {
+    t.Fatal(err)
+  }
+  expectBodies(t, leaseTestBodies(t, q, 10, nil), "c")
+}
+
+func TestSQLLeaseMessagesFilter(t *testing.T) {
+  startTestSQL(t)
+  q := createTestQueue(t, "q", QueueSettings{})
+  attributes := []map[string]string{
+    {"type": "invoice", "region": "eu"},
+    {"type": "order"},
+    {"note": `"type":"invoice"`},
+    {"type": "invoice"},
+    nil,
+  }
+  saveTestMessages(t, q, []string{"a", "b", "c", "d", "e"}, func(i int, m *Message) { m.Attributes = attributes[i] })
+  expectBodies(t, leaseTestBodies(t, q, 10, map[string]string{"type": "invoice", "region": "eu"}), "a")
+  expectBodies(t, leaseTestBodies(t, q, 10, map[string]string{"type": "invoice"}), "d")
+  expectBodies(t, leaseTestBodies(t, q, 10, nil), "b", "c", "e")
+}
@@ -0,0 +1,149 @@
+package gotcha
+
+/*
+  This file defines the interface implemented by storage backends
+
+  The functions and methods on Project, Queue and Message never access a
+  database directly, they go through 'Storage' instead.
+  Expired messages are never loaded, counted or leased by backends, they are
+  eventually deleted by DestroyExpiredMessages. Backends are
+  initialized by their own start function (e.g. StartSession for MongoDB)
+  which sets 'Storage' once the backend is ready to be used.
+*/
+
+import (
+  "errors"
+  "labix.org/v2/mgo/bson"
+  "time"
+)
+
+// Current storage backend if any
+// Initialize by calling the start function of the desired backend
+var Storage Store
+
+// Error returned by backends when a project, queue or message cannot be found
+var ErrNotFound = errors.New("not found")
+
+// Error returned when operating on a message whose lease has expired
+var ErrLeaseExpired = errors.New("lease expired")
+
+// Error returned when operating on a message with a receipt other than the
+// one handed out by its current lease
+var ErrInvalidReceipt = errors.New("invalid receipt")
+
+// Operations a storage backend must provide
+// Backends must be safe for concurrent use
+type Store interface {
+  // Projects
+  ListProjects() (*[]Project, error)                 // List all projects
+  InsertProject(p *Project) error                    // Save new project
+  LoadProject(name string) (*Project, error)         // Load project with given name
+  LoadProjectId(id bson.ObjectId) (*Project, error)  // Load project with given id
+  DestroyProject(p *Project) error                   // Delete project (but not its queues)
+
+  // Queues
+  ListQueues(p *Project) (*[]Queue, error)           // List all queues in project
+  CountQueues(p *Project) (int, error)               // Number of queues in project
+  InsertQueue(q *Queue) error                        // Save new queue
+  LoadQueue(p *Project, name string) (*Queue, error) // Load queue with given name from project
+  LoadQueueId(id bson.ObjectId) (*Queue, error)      // Load queue with given id
+  DestroyQueue(q *Queue) error                       // Delete queue (but not its messages)
+
+  // Topics
+  ListTopics(p *Project) (*[]Topic, error)           // List all topics in project
+  InsertTopic(t *Topic) error                        // Save new topic, names must be unique in project
+  LoadTopic(p *Project, name string) (*Topic, error) // Load topic with given name from project
+  DestroyTopic(t *Topic) error                       // Delete topic (but not its subscriptions)
+
+  // Subscriptions
+  InsertSubscription(s *Subscription) error          // Save new subscription, at most one per topic and queue
+  DestroySubscription(s *Subscription) error         // Delete subscription
+
+  // List all subscriptions of topic
+  ListSubscriptions(t *Topic) (*[]Subscription, error)
+
+  // Load subscription of given queue to topic
+  LoadSubscription(t *Topic, q *Queue) (*Subscription, error)
+
+  // Subscribers
+  ListSubscribers(q *Queue) (*[]Subscriber, error)   // List all subscribers of queue
+  InsertSubscriber(s *Subscriber) error              // Save new subscriber, names must be unique in queue
+  DestroySubscriber(s *Subscriber) error             // Delete subscriber
+
+  // Load subscriber with given name from queue
+  LoadSubscriber(q *Queue, name string) (*Subscriber, error)
+
+  // Tokens
+  ListTokens(p *Project) (*[]Token, error)           // List all tokens of project
+  InsertToken(t *Token) error                        // Save new token, names must be unique in project
+  LoadToken(p *Project, name string) (*Token, error) // Load token with given name from project
+  LoadTokenHash(hash string) (*Token, error)         // Load token with given secret hash
+  DestroyToken(t *Token) error                       // Delete token
+
+  // Messages
+  InsertMessages(messages *[]*Message) error         // Save new messages, all messages are saved or none
+  LoadMessage(id bson.ObjectId) (*Message, error)    // Load message with given id
+  DestroyMessage(m *Message) error                   // Delete message
+  ClearMessages(q *Queue) (int, error)               // Delete all messages from queue, return count
+
+  // Compute counts of messages in queue that are unexpired at 'now'
+  QueueStats(q *Queue, now time.Time) (*QueueStats, error)
+
+  // Lease up to 'count' unexpired messages from queue whose lease expired
+  // before 'now', in the order defined by the queue ordering
+  // Messages that were leased q.MaxAttempts times already are skipped, so
+  // are messages that don't have all the attributes in 'filter' if any
+  // Messages with a group are skipped unless they are the oldest unexpired
+  // message of their group in the queue (by creation time then id)
+  // Leased messages have their lease set to expire at 'until', their
+  // attempts incremented and a new receipt (see newReceipt)
+  // Each message must be leased atomically so it is never handed out twice
+  LeaseMessages(q *Queue, count int, filter map[string]string, now, until time.Time) (*[]*Message, error)
+
+  // Set lease of message with given id and receipt in queue to expire at 'until'
+  // Message must be unexpired and leased at 'now', return ErrNotFound otherwise
+  ExtendLease(q *Queue, id bson.ObjectId, receipt string, now, until time.Time) (*Message, error)
+
+  // Put message with given id and receipt back in queue so that it can be
+  // leased again from 'visibleAt' on (right away if 'visibleAt' is zero)
+  // Message must be unexpired and leased at 'now', return ErrNotFound otherwise
+  // The message receipt is cleared
+  ReleaseMessage(q *Queue, id bson.ObjectId, receipt string, now, visibleAt time.Time) error
+
+  // Delete message with given id and receipt from queue
+  // Return ErrNotFound if there is no such message
+  DestroyLeasedMessage(q *Queue, id bson.ObjectId, receipt string) error
+
+  // Move unexpired messages from queue whose lease expired before 'now' and
+  // that were leased q.MaxAttempts times to dead-letter queue 'dlq'
+  // Moved messages have their attempts reset and their origin set to 'q'
+  // Return number of moved messages
+  DeadLetterMessages(q, dlq *Queue, now time.Time) (int, error)
+
+  // Move up to 'max' unexpired messages from dead-letter queue 'dlq' whose
+  // lease expired before 'now' and whose origin is 'q' back to 'q', clear
+  // their origin and reset their attempts
+  // Return number of moved messages
+  RedriveMessages(dlq, q *Queue, now time.Time, max int) (int, error)
+
+  // Delete up to 'max' messages from queue that expired before 'now'
+  // Atomically add number of deleted messages to queue ExpiredCount
+  // Return number of deleted messages
+  DestroyExpiredMessages(q *Queue, now time.Time, max int) (int, error)
+
+  // Save deduplication record unless a record with the same queue and
+  // deduplication id exists and hasn't expired at 'now', return the record
+  // that is in effect (the given one or the existing one)
+  // Expired records are replaced, the check and the save must be atomic
+  // (e.g. enforced by a unique index) so concurrent claims never both succeed
+  ClaimDeduplication(d *Deduplication, now time.Time) (*Deduplication, error)
+
+  DestroyDeduplication(d *Deduplication) error       // Delete deduplication record
+  ClearDeduplications(q *Queue) error                // Delete all deduplication records of queue
+
+  // Delete up to 'max' deduplication records of queue that expired before 'now'
+  DestroyExpiredDeduplications(q *Queue, now time.Time, max int) (int, error)
+
+  // Release any resource held by backend
+  Close()
+}
@@ -0,0 +1,136 @@
+package gotcha
+
+import (
+  "errors"
+  "fmt"
+  "labix.org/v2/mgo/bson"
+  "net/url"
+  "time"
+)
+
+// A subscriber is an HTTP endpoint messages of a queue are pushed to
+// Queues with subscribers are push queues, see gotcha_app/pusher.go
+type Subscriber struct {
+  ID                 bson.ObjectId "_id,omitempty"
+  Name               string        "name"
+  QueueID            bson.ObjectId "queue"
+  ProjectID          bson.ObjectId "project"
+  CreatedAt          time.Time     "created_at"
+  SubscriberSettings ",inline"
+}
+
+// Subscriber settings that can be set on creation
+type SubscriberSettings struct {
+  URL           string        "url"             // URL messages are POSTed to
+  Timeout       time.Duration "timeout"         // Maximum duration of each delivery request
+  RetryDelay    time.Duration "retry_delay"     // Delay before first retry after a failed delivery
+  MaxRetryDelay time.Duration "max_retry_delay" // Maximum delay between retries
+}
+
+// Subscriber information returned by APIs
+type SubscriberInfo struct {
+  Name          string    `json:"name"`          // Name of subscriber (unique in queue)
+  QueueName     string    `json:"queue"`         // Name of queue messages are pushed from
+  ProjectName   string    `json:"project"`       // Name of project containing queue
+  CreatedAt     time.Time `json:"createdAt"`     // Creation timestamp
+  URL           string    `json:"url"`           // URL messages are POSTed to
+  Timeout       int       `json:"timeout"`       // Maximum duration of each delivery request in seconds
+  RetryDelay    int       `json:"retryDelay"`    // Delay before first retry in seconds
+  MaxRetryDelay int       `json:"maxRetryDelay"` // Maximum delay between retries in seconds
+}
+
+// Default timeout of delivery requests
+const DefaultSubscriberTimeout = time.Duration(10) * time.Second
+
+// Minimum timeout of delivery requests is 1 second
+const MinSubscriberTimeout = time.Duration(1) * time.Second
+
+// Maximum timeout of delivery requests is 1 minute
+const MaxSubscriberTimeout = time.Duration(1) * time.Minute
+
+// Default delay before first retry
+const DefaultRetryDelay = time.Duration(10) * time.Second
+
+// Default maximum delay between retries
+const DefaultMaxRetryDelay = time.Duration(1) * time.Hour
+
+// Maximum number of subscribers a single queue can have
+const MaxSubscribersPerQueue = 100
+
+// Create new subscriber pushing messages of given queue to given URL
+// Zero settings are given their default value
+func NewSubscriber(name string, q *Queue, settings SubscriberSettings) (*Subscriber, error) {
+  if u, err := url.Parse(settings.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+    return nil, errors.New(fmt.Sprintf("Invalid URL '%v' (must be an absolute http or https URL)", settings.URL))
+  }
+  if settings.Timeout == 0 {
+    settings.Timeout = DefaultSubscriberTimeout
+  }
+  if settings.RetryDelay == 0 {
+    settings.RetryDelay = DefaultRetryDelay
+  }
+  if settings.MaxRetryDelay == 0 {
+    settings.MaxRetryDelay = DefaultMaxRetryDelay
+  }
+  if settings.Timeout < MinSubscriberTimeout || settings.Timeout > MaxSubscriberTimeout {
+    return nil, errors.New(fmt.Sprintf("Invalid timeout %v (must be >= %v and <= %v)", settings.Timeout, MinSubscriberTimeout, MaxSubscriberTimeout))
+  }
+  if settings.RetryDelay > settings.MaxRetryDelay || settings.MaxRetryDelay > MaxMessageDelay {
+    return nil, errors.New(fmt.Sprintf("Invalid retry delays (retry delay must be <= maximum retry delay which must be <= %v)", MaxMessageDelay))
+  }
+  subs, err := q.Subscribers()
+  if err != nil {
+    return nil, err
+  }
+  if len(*subs) >= MaxSubscribersPerQueue {
+    return nil, errors.New(fmt.Sprintf("Maximum number of subscribers (%v) reached for queue '%v'", MaxSubscribersPerQueue, q.Name))
+  }
+  s := Subscriber{ID: bson.NewObjectId(), Name: name, QueueID: q.ID, ProjectID: q.ProjectID, CreatedAt: time.Now().UTC(),
+    SubscriberSettings: settings}
+  if err := Storage.InsertSubscriber(&s); err != nil {
+    return nil, err
+  }
+  return &s, nil
+}
+
+// Return all subscribers of queue
+func (q *Queue) Subscribers() (*[]Subscriber, error) {
+  return Storage.ListSubscribers(q)
+}
+
+// Return subscriber with given name, return ErrNotFound if not found
+func (q *Queue) Subscriber(name string) (*Subscriber, error) {
+  return Storage.LoadSubscriber(q, name)
+}
+
+// Return info about this subscriber
+func (s *Subscriber) Info() (*SubscriberInfo, error) {
+  q, err := Storage.LoadQueueId(s.QueueID)
+  if err != nil {
+    return nil, err
+  }
+  p, err := Storage.LoadProjectId(s.ProjectID)
+  if err != nil {
+    return nil, err
+  }
+  return &SubscriberInfo{Name: s.Name, QueueName: q.Name, ProjectName: p.Name, CreatedAt: s.CreatedAt, URL: s.URL,
+    Timeout: int(s.Timeout.Seconds()), RetryDelay: int(s.RetryDelay.Seconds()), MaxRetryDelay: int(s.MaxRetryDelay.Seconds())}, nil
+}
+
+// Delete subscriber
+func (s *Subscriber) Destroy() error {
+  return Storage.DestroySubscriber(s)
+}
+
+// Delay before retrying delivery of a message that was delivered 'attempts'
+// times, doubles with each attempt up to MaxRetryDelay
+func (s *Subscriber) RetryDelayAfter(attempts int) time.Duration {
+  delay := s.RetryDelay
+  for i := 1; i < attempts && delay < s.MaxRetryDelay; i++ {
+    delay *= 2
+  }
+  if delay > s.MaxRetryDelay {
+    delay = s.MaxRetryDelay
+  }
+  return delay
+}
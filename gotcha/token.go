@@ -0,0 +1,239 @@
+package gotcha
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "labix.org/v2/mgo/bson"
+  "log"
+  "strings"
+  "time"
+)
+
+// An API token grants access to the project it belongs to
+// Only the SHA-256 hash of the token secret is stored, the secret itself is
+// returned once on creation and cannot be retrieved afterwards
+// Scopes restrict the operations the token can be used for and Queues, if
+// not empty, the queues it can be used on (see Authorize)
+// Tokens also get a signing secret clients sign requests with when a signing
+// secrets key is set (see SetSigningSecretsKey), it is stored encrypted with
+// that key and also returned once on creation
+type Token struct {
+  ID            bson.ObjectId "_id,omitempty"
+  Name          string        "name"
+  ProjectID     bson.ObjectId "project"
+  Hash          string        "hash"
+  CreatedAt     time.Time     "created_at"
+  Scopes        []string      "scopes,omitempty"
+  Queues        []string      "queues,omitempty"
+  SigningSecret string        "signing_secret,omitempty"
+}
+
+// Token information returned by APIs
+type TokenInfo struct {
+  Name          string    `json:"name"`                    // Name of token (unique in project)
+  ProjectName   string    `json:"project"`                 // Name of project token grants access to
+  CreatedAt     time.Time `json:"createdAt"`               // Creation timestamp
+  Scopes        []string  `json:"scopes"`                  // Operations token can be used for, see Scope* constants
+  Queues        []string  `json:"queues,omitempty"`        // Names of queues token is restricted to if any
+  Secret        string    `json:"token,omitempty"`         // Token secret, only set on creation
+  SigningSecret string    `json:"signingSecret,omitempty"` // Secret signing requests, only set on creation
+}
+
+// Token scopes
+const (
+  ScopeEnqueue = "enqueue" // Add messages to queues and publish messages to topics
+  ScopeConsume = "consume" // Lease, delete, release and touch messages
+  ScopeAdmin   = "admin"   // All operations, including managing projects, queues, topics and tokens
+)
+
+// Error returned when a token has no signing secret that can be decrypted
+var ErrNoSigningSecret = errors.New("token has no signing secret")
+
+// Cipher encrypting token signing secrets and its key, nil if no key was set
+var signingSecrets cipher.AEAD
+var signingSecretsKey []byte
+
+// Maximum number of tokens a single project can have
+const MaxTokensPerProject = 100
+
+// Maximum number of queues a single token can be restricted to
+const MaxTokenQueues = 100
+
+// Create new token granting access to given project
+// Scopes default to ScopeAdmin if empty, queues may not exist yet
+// Return the token and its secret, the secret is not stored
+func NewToken(name string, project *Project, scopes, queues []string) (*Token, string, error) {
+  if len(scopes) == 0 {
+    scopes = []string{ScopeAdmin}
+  }
+  for _, s := range scopes {
+    if s != ScopeEnqueue && s != ScopeConsume && s != ScopeAdmin {
+      return nil, "", errors.New(fmt.Sprintf("Invalid scope '%v' (must be one of '%v', '%v' or '%v')", s, ScopeEnqueue, ScopeConsume, ScopeAdmin))
+    }
+  }
+  if len(queues) > MaxTokenQueues {
+    return nil, "", errors.New(fmt.Sprintf("Tokens cannot be restricted to more than %v queues", MaxTokenQueues))
+  }
+  ts, err := project.Tokens()
+  if err != nil {
+    return nil, "", err
+  }
+  if len(*ts) >= MaxTokensPerProject {
+    return nil, "", errors.New(fmt.Sprintf("Maximum number of tokens (%v) reached for project '%v'", MaxTokensPerProject, project.Name))
+  }
+  secret := newSecret()
+  t := Token{ID: bson.NewObjectId(), Name: name, ProjectID: project.ID, Hash: HashSecret(secret), CreatedAt: time.Now().UTC(),
+    Scopes: scopes, Queues: queues}
+  if signingSecrets != nil {
+    nonce := make([]byte, signingSecrets.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+      return nil, "", err
+    }
+    t.SigningSecret = hex.EncodeToString(signingSecrets.Seal(nonce, nonce, []byte(newSecret()), []byte(t.ID)))
+  }
+  if err := Storage.InsertToken(&t); err != nil {
+    return nil, "", err
+  }
+  return &t, secret, nil
+}
+
+// Load token whose secret is given, return ErrNotFound if there is none
+func Authenticate(secret string) (*Token, error) {
+  if secret == "" {
+    return nil, ErrNotFound
+  }
+  return Storage.LoadTokenHash(HashSecret(secret))
+}
+
+// Hex encoded SHA-256 hash of token secret
+// Secrets are random so they don't need a slow or salted hash
+func HashSecret(secret string) string {
+  h := sha256.Sum256([]byte(secret))
+  return hex.EncodeToString(h[:])
+}
+
+// Set key encrypting the signing secrets of tokens created from now on and
+// decrypting those of existing tokens, key must be 32 bytes long (AES-256-GCM)
+// A nil key disables signing secrets
+func SetSigningSecretsKey(key []byte) error {
+  if key == nil {
+    signingSecrets, signingSecretsKey = nil, nil
+    return nil
+  }
+  if len(key) != 32 {
+    return errors.New(fmt.Sprintf("Signing secrets key must be 32 bytes long (got %v)", len(key)))
+  }
+  block, err := aes.NewCipher(key)
+  if err != nil {
+    return err
+  }
+  aead, err := cipher.NewGCM(block)
+  if err != nil {
+    return err
+  }
+  signingSecrets, signingSecretsKey = aead, key
+  return nil
+}
+
+// Key set with SetSigningSecretsKey, nil if signing secrets are disabled
+func SigningSecretsKey() []byte {
+  return signingSecretsKey
+}
+
+// Decrypt signing secret of token
+// Return ErrNoSigningSecret if token was created without one or it cannot
+// be decrypted with the current signing secrets key
+func (t *Token) DecryptSigningSecret() (string, error) {
+  sealed, err := hex.DecodeString(t.SigningSecret)
+  if t.SigningSecret == "" || signingSecrets == nil || err != nil || len(sealed) < signingSecrets.NonceSize() {
+    return "", ErrNoSigningSecret
+  }
+  nonce, sealed := sealed[:signingSecrets.NonceSize()], sealed[signingSecrets.NonceSize():]
+  secret, err := signingSecrets.Open(nil, nonce, sealed, []byte(t.ID))
+  if err != nil {
+    return "", ErrNoSigningSecret
+  }
+  return string(secret), nil
+}
+
+// Generate random token secret
+func newSecret() string {
+  b := make([]byte, 32)
+  if _, err := rand.Read(b); err != nil {
+    log.Panicf("Failed to generate token secret: %v", err)
+  }
+  return hex.EncodeToString(b)
+}
+
+// Return all tokens of given project
+func (p *Project) Tokens() (*[]Token, error) {
+  return Storage.ListTokens(p)
+}
+
+// Return token with given name from given project
+func (p *Project) Token(name string) (*Token, error) {
+  return Storage.LoadToken(p, name)
+}
+
+// Return info about this token, the secret is never included
+func (t *Token) Info() (*TokenInfo, error) {
+  p, err := Storage.LoadProjectId(t.ProjectID)
+  if err != nil {
+    return nil, err
+  }
+  return &TokenInfo{Name: t.Name, ProjectName: p.Name, CreatedAt: t.CreatedAt, Scopes: t.scopes(), Queues: t.Queues}, nil
+}
+
+// Check that token can be used for an operation requiring one of given
+// scopes on queue with given name, queue is empty for operations that don't
+// target a single queue
+// Return an error explaining why the operation is not allowed otherwise
+func (t *Token) Authorize(queue string, scopes ...string) error {
+  if len(t.Queues) > 0 {
+    if queue == "" {
+      return errors.New(fmt.Sprintf("token '%v' is restricted to queues '%v' and cannot be used for operations that are not on a single queue",
+        t.Name, strings.Join(t.Queues, "', '")))
+    }
+    found := false
+    for _, q := range t.Queues {
+      found = found || q == queue
+    }
+    if !found {
+      return errors.New(fmt.Sprintf("token '%v' does not grant access to queue '%v'", t.Name, queue))
+    }
+  }
+  required := []string{ScopeAdmin}
+  for _, s := range scopes {
+    if s != ScopeAdmin {
+      required = append(required, s)
+    }
+  }
+  for _, s := range t.scopes() {
+    for _, r := range required {
+      if s == r {
+        return nil
+      }
+    }
+  }
+  return errors.New(fmt.Sprintf("token '%v' has scopes '%v' but this operation requires one of '%v'",
+    t.Name, strings.Join(t.scopes(), "', '"), strings.Join(required, "', '")))
+}
+
+// Scopes of token, tokens created before scopes were introduced have the
+// admin scope
+func (t *Token) scopes() []string {
+  if len(t.Scopes) == 0 {
+    return []string{ScopeAdmin}
+  }
+  return t.Scopes
+}
+
+// Revoke token
+func (t *Token) Destroy() error {
+  return Storage.DestroyToken(t)
+}
@@ -0,0 +1,231 @@
+package gotcha
+
+import (
+  "errors"
+  "fmt"
+  "labix.org/v2/mgo/bson"
+  "time"
+)
+
+// A topic fans out published messages to the queues subscribed to it
+type Topic struct {
+  ID        bson.ObjectId "_id,omitempty"
+  Name      string        "name"
+  ProjectID bson.ObjectId "project"
+  CreatedAt time.Time     "created_at"
+}
+
+// A subscription of a queue to a topic
+// Only messages whose attributes match all entries of the filter are
+// enqueued in the queue, an empty filter matches all messages
+type Subscription struct {
+  ID        bson.ObjectId     "_id,omitempty"
+  TopicID   bson.ObjectId     "topic"
+  QueueID   bson.ObjectId     "queue"
+  ProjectID bson.ObjectId     "project"
+  CreatedAt time.Time         "created_at"
+  Filter    map[string]string "filter,omitempty"
+}
+
+// Topic information returned by APIs
+type TopicInfo struct {
+  Name          string             `json:"name"`          // Name of topic (unique in project)
+  ProjectName   string             `json:"project"`       // Name of project containing topic
+  CreatedAt     time.Time          `json:"createdAt"`     // Creation timestamp
+  Subscriptions []SubscriptionInfo `json:"subscriptions"` // Subscriptions of queues to topic
+}
+
+// Subscription information returned by APIs
+type SubscriptionInfo struct {
+  QueueName string            `json:"queue"`            // Name of subscribed queue
+  CreatedAt time.Time         `json:"createdAt"`        // Creation timestamp
+  Filter    map[string]string `json:"filter,omitempty"` // Attributes messages must have to be enqueued
+}
+
+// Maximum number of topics a single project can hold
+const MaxTopicsPerProject = 10000
+
+// Maximum number of queues subscribed to a single topic
+const MaxSubscriptionsPerTopic = 100
+
+// Create new topic
+func NewTopic(name string, project *Project) (*Topic, error) {
+  ts, err := project.Topics()
+  if err != nil {
+    return nil, err
+  }
+  if len(*ts) >= MaxTopicsPerProject {
+    return nil, errors.New(fmt.Sprintf("Maximum number of topics (%v) reached for project '%v'", MaxTopicsPerProject, project.Name))
+  }
+  t := Topic{ID: bson.NewObjectId(), Name: name, ProjectID: project.ID, CreatedAt: time.Now().UTC()}
+  if err := Storage.InsertTopic(&t); err != nil {
+    return nil, err
+  }
+  return &t, nil
+}
+
+// Return all topics from given project
+func (p *Project) Topics() (*[]Topic, error) {
+  return Storage.ListTopics(p)
+}
+
+// Return topic with given name from given project
+func (p *Project) Topic(name string) (*Topic, error) {
+  return Storage.LoadTopic(p, name)
+}
+
+// Return info about this topic
+func (t *Topic) Info() (*TopicInfo, error) {
+  p, err := Storage.LoadProjectId(t.ProjectID)
+  if err != nil {
+    return nil, err
+  }
+  subs, err := t.Subscriptions()
+  if err != nil {
+    return nil, err
+  }
+  infos := make([]SubscriptionInfo, 0, len(*subs))
+  for _, s := range *subs {
+    q, err := Storage.LoadQueueId(s.QueueID)
+    if err != nil {
+      return nil, err
+    }
+    infos = append(infos, SubscriptionInfo{QueueName: q.Name, CreatedAt: s.CreatedAt, Filter: s.Filter})
+  }
+  return &TopicInfo{Name: t.Name, ProjectName: p.Name, CreatedAt: t.CreatedAt, Subscriptions: infos}, nil
+}
+
+// Destroy topic and its subscriptions, subscribed queues are left untouched
+func (t *Topic) Destroy() error {
+  if subs, err := t.Subscriptions(); err != nil {
+    return err
+  } else {
+    for _, s := range *subs {
+      if err := s.Destroy(); err != nil {
+        return err
+      }
+    }
+  }
+  return Storage.DestroyTopic(t)
+}
+
+// Subscribe queue to topic, queue must belong to the same project
+// Update filter if queue is already subscribed
+func (t *Topic) Subscribe(q *Queue, filter map[string]string) (*Subscription, error) {
+  if q.ProjectID != t.ProjectID {
+    return nil, errors.New(fmt.Sprintf("Queue '%v' does not belong to the project of topic '%v'", q.Name, t.Name))
+  }
+  if err := ValidateAttributes(filter); err != nil {
+    return nil, err
+  }
+  if s, err := t.Subscription(q); err == nil {
+    if err := s.Destroy(); err != nil {
+      return nil, err
+    }
+  } else if err != ErrNotFound {
+    return nil, err
+  }
+  subs, err := t.Subscriptions()
+  if err != nil {
+    return nil, err
+  }
+  if len(*subs) >= MaxSubscriptionsPerTopic {
+    return nil, errors.New(fmt.Sprintf("Maximum number of subscriptions (%v) reached for topic '%v'", MaxSubscriptionsPerTopic, t.Name))
+  }
+  s := Subscription{ID: bson.NewObjectId(), TopicID: t.ID, QueueID: q.ID, ProjectID: t.ProjectID, CreatedAt: time.Now().UTC(),
+    Filter: filter}
+  if err := Storage.InsertSubscription(&s); err != nil {
+    return nil, err
+  }
+  return &s, nil
+}
+
+// Return all subscriptions of topic
+func (t *Topic) Subscriptions() (*[]Subscription, error) {
+  return Storage.ListSubscriptions(t)
+}
+
+// Return subscription of given queue to topic, return ErrNotFound if queue
+// is not subscribed
+func (t *Topic) Subscription(q *Queue) (*Subscription, error) {
+  return Storage.LoadSubscription(t, q)
+}
+
+// Enqueue a copy of each message in each subscribed queue whose filter
+// matches the message attributes
+// The ID, queue and project of messages are ignored, priorities are only
+// kept for queues with priority ordering
+// All copies are saved at once so that either all queues get the messages or
+// none do
+// Deduplication ids apply to each queue, copies that are duplicates get the
+// id of the original message
+// Return ids of copies indexed by queue name
+func (t *Topic) Publish(messages []*Message) (map[string][]string, error) {
+  subs, err := t.Subscriptions()
+  if err != nil {
+    return nil, err
+  }
+  copies := make([]*Message, 0, len(messages) * len(*subs))
+  names := make(map[bson.ObjectId]string, len(*subs))
+  for _, s := range *subs {
+    q, err := Storage.LoadQueueId(s.QueueID)
+    if err != nil {
+      return nil, err
+    }
+    names[q.ID] = q.Name
+    for _, m := range messages {
+      if !s.Matches(m) {
+        continue
+      }
+      c := *m
+      c.ID, c.QueueID, c.ProjectID = bson.NewObjectId(), q.ID, q.ProjectID
+      if q.ordering() != OrderPriority {
+        c.Priority = 0
+      }
+      copies = append(copies, &c)
+    }
+  }
+  if err := SaveMessages(&copies); err != nil {
+    return nil, err
+  }
+  ids := make(map[string][]string, len(names))
+  for _, name := range names {
+    ids[name] = make([]string, 0)
+  }
+  for _, c := range copies {
+    ids[names[c.QueueID]] = append(ids[names[c.QueueID]], c.ID.Hex())
+  }
+  return ids, nil
+}
+
+// Whether message attributes match subscription filter
+func (s *Subscription) Matches(m *Message) bool {
+  return m.hasAttributes(s.Filter)
+}
+
+// Delete subscription
+func (s *Subscription) Destroy() error {
+  return Storage.DestroySubscription(s)
+}
+
+// Delete subscriptions of queue to topics of its project
+func (q *Queue) unsubscribe() error {
+  p, err := Storage.LoadProjectId(q.ProjectID)
+  if err != nil {
+    return err
+  }
+  ts, err := p.Topics()
+  if err != nil {
+    return err
+  }
+  for _, t := range *ts {
+    if s, err := t.Subscription(q); err == nil {
+      if err := s.Destroy(); err != nil {
+        return err
+      }
+    } else if err != ErrNotFound {
+      return err
+    }
+  }
+  return nil
+}
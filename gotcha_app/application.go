@@ -1,6 +1,8 @@
 package main
 
 import (
+  "encoding/base64"
+  "encoding/hex"
   "encoding/json"
   "errors"
   "flag"
@@ -10,10 +12,15 @@ import (
   "io/ioutil"
   "labix.org/v2/mgo/bson"
   "log"
+  "math"
+  "mime"
 	"net/http"
+  "net/url"
   "os"
   "path/filepath"
 	"github.com/bmizerany/pat"
+  _ "github.com/lib/pq"
+  _ "github.com/mattn/go-sqlite3"
   "launchpad.net/goyaml"
   "strconv"
   "strings"
@@ -23,11 +30,27 @@ import (
 // Default settings
 func defaultSettings() map[string]string{
   return map[string]string{
-    "port":          "8000",
-    "environment":   "development",
-    "mongoHost":     "localhost",
-    "mongoUser":     "",
-    "mongoPassword": "",
+    "port":                 "8000",
+    "environment":          "development",
+    "storage":              "mongo",
+    "mongoHost":            "localhost",
+    "mongoUser":            "",
+    "mongoPassword":        "",
+    "boltPath":             "gotcha.db",
+    "sqlDriver":            "sqlite3",
+    "sqlSource":            "gotcha.sqlite",
+    "reaperInterval":       "60",
+    "reaperBatchSize":      "1000",
+    "maxBodySize":          "262144",
+    "maxRequestSize":       "1048576",
+    "adminToken":           "",
+    "signatureWindow":      "300",
+    "signingSecretsKey":    "",
+    "tlsCertFile":          "",
+    "tlsKeyFile":           "",
+    "tlsClientCAFile":      "",
+    "tlsRequireClientCert": "false",
+    "tlsClientProjects":    "",
   }
 }
 
@@ -46,62 +69,195 @@ const MinMessageTimeout = time.Duration(10) * time.Second // * 1000 * 1000 * 100
 // Maximum timeout for lease is 24 hours
 const MaxMessageTimeout = time.Duration(24) * time.Hour //24 * 60 * 60 * 1000 * 1000 * 1000)
 
+// Maximum time a lease request may wait for messages is 30 seconds
+const MaxLeaseWait = time.Duration(30) * time.Second
+
+// Maximum size of a message body in bytes, see maxBodySize setting
+var maxBodySize = 256 * 1024
+
+// Maximum size of requests adding or publishing messages in bytes, see
+// maxRequestSize setting
+var maxRequestSize = 1024 * 1024
+
 // Current settings
 var globalSettings map[string]string
 
-// Load configuration settings and setup database connection
+// Path to configuration file
+var confFile string
+
+// Register command line flags
 func init() {
-  globalSettings := make(map[string]string)
-  var confFile string
   flag.StringVar(&confFile, "config", "config.yml", "Path to config file")
-  flag.Parse()
+}
+
+// Load configuration settings from given file, use defaults for missing settings
+func loadSettings(confFile string) map[string]string {
+  settings := make(map[string]string)
   if confFile, err := filepath.Abs(confFile); err != nil {
     log.Printf("Cannot find configuration file '%v', using default settings", confFile)
   } else if raw, err := ioutil.ReadFile(confFile); err != nil {
     log.Printf("[%v] Cannot load configuration file '%v', using default settings", os.Getpid(), confFile)
   } else {
-    err := goyaml.Unmarshal(raw, &globalSettings)
+    err := goyaml.Unmarshal(raw, &settings)
     if err != nil {
       log.Printf("Cannot load configuration settings: %v", err)
     }
   }
   for setting, value := range defaultSettings() {
-    if _, ok := globalSettings[setting]; !ok {
-      globalSettings[setting] = value
+    if _, ok := settings[setting]; !ok {
+      settings[setting] = value
+    }
+  }
+  return settings
+}
+
+// Setup storage backend selected by the "storage" setting
+//   - mongo:  MongoDB, see mongoHost, mongoUser and mongoPassword settings
+//   - bolt:   BoltDB file, see boltPath setting
+//   - sql:    SQLite or PostgreSQL, see sqlDriver and sqlSource settings
+//   - memory: In-memory, nothing is persisted
+func startStorage(settings map[string]string) error {
+  switch settings["storage"] {
+  case "mongo":
+    return gotcha.StartSession(settings["mongoHost"], settings["mongoUser"],
+      settings["mongoPassword"], settings["environment"])
+  case "bolt":
+    return gotcha.StartBolt(settings["boltPath"])
+  case "sql":
+    return gotcha.StartSQL(settings["sqlDriver"], settings["sqlSource"])
+  case "memory":
+    gotcha.Storage = gotcha.NewMemoryStore()
+    return nil
+  }
+  return errors.New(fmt.Sprintf("Unknown storage '%v'", settings["storage"]))
+}
+
+// Create HTTP handler serving all API routes
+func newRouter() http.Handler {
+  m := pat.New()
+  m.Get("/projects", scoped(listProjects, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName", scoped(createProject, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName", scoped(showProject, gotcha.ScopeAdmin))
+  m.Del("/projects/:projectName", scoped(deleteProject, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/tokens", scoped(listTokens, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/tokens/:tokenName", scoped(createToken, gotcha.ScopeAdmin))
+  m.Del("/projects/:projectName/tokens/:tokenName", scoped(deleteToken, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/queues", scoped(listQueues, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/queues/:queueName", scoped(createQueue, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/queues/:queueName", scoped(showQueue, gotcha.ScopeEnqueue, gotcha.ScopeConsume))
+  m.Del("/projects/:projectName/queues/:queueName", scoped(deleteQueue, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/queues/:queueName/clear", scoped(clearQueue, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/queues/:queueName/redrive", scoped(redriveQueue, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/queues/:queueName/subscribers", scoped(listSubscribers, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/queues/:queueName/subscribers/:subscriberName", scoped(createSubscriber, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/queues/:queueName/subscribers/:subscriberName", scoped(showSubscriber, gotcha.ScopeAdmin))
+  m.Del("/projects/:projectName/queues/:queueName/subscribers/:subscriberName", scoped(deleteSubscriber, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/queues/:queueName/messages", scoped(addMessages, gotcha.ScopeEnqueue))
+  m.Get("/projects/:projectName/queues/:queueName/messages", scoped(getMessages, gotcha.ScopeConsume))
+  m.Post("/projects/:projectName/queues/:queueName/messages/delete", scoped(deleteMessages, gotcha.ScopeConsume))
+  m.Post("/projects/:projectName/queues/:queueName/messages/release", scoped(releaseMessages, gotcha.ScopeConsume))
+  m.Post("/projects/:projectName/queues/:queueName/messages/:messageId/touch", scoped(touchMessage, gotcha.ScopeConsume))
+  m.Get("/projects/:projectName/queues/:queueName/stream", scoped(streamMessages, gotcha.ScopeConsume))
+  m.Post("/projects/:projectName/queues/:queueName/stream/:streamId/ack", scoped(ackMessages, gotcha.ScopeConsume))
+  m.Get("/projects/:projectName/topics", scoped(listTopics, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/topics/:topicName", scoped(createTopic, gotcha.ScopeAdmin))
+  m.Get("/projects/:projectName/topics/:topicName", scoped(showTopic, gotcha.ScopeAdmin))
+  m.Del("/projects/:projectName/topics/:topicName", scoped(deleteTopic, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/topics/:topicName/subscriptions/:queueName", scoped(subscribeQueue, gotcha.ScopeAdmin))
+  m.Del("/projects/:projectName/topics/:topicName/subscriptions/:queueName", scoped(unsubscribeQueue, gotcha.ScopeAdmin))
+  m.Post("/projects/:projectName/topics/:topicName/messages", scoped(publishMessages, gotcha.ScopeEnqueue))
+
+  return httpLogger{Handler: authenticator{Handler: m}}
+}
+
+// Entry point, load settings, setup storage and start server
+func main() {
+  flag.Parse()
+  globalSettings = loadSettings(confFile)
+  logged := make(map[string]string, len(globalSettings))
+  for k, v := range globalSettings {
+    logged[k] = v
+  }
+  for _, secret := range []string{"adminToken", "signingSecretsKey"} {
+    if logged[secret] != "" {
+      logged[secret] = "<hidden>"
     }
   }
-  msg, err := goyaml.Marshal(&globalSettings)
+  msg, err := goyaml.Marshal(&logged)
   if err != nil {
     log.Fatalf("Could not log settings: %v", err)
   }
   log.Printf("Startup settings:\n%s", msg)
 
-  gotcha.StartSession(globalSettings["mongoHost"], globalSettings["mongoUser"],
-    globalSettings["mongoPassword"], globalSettings["environment"])
-}
+  if err := startStorage(globalSettings); err != nil {
+    log.Fatalf("Could not setup storage: %v", err)
+  }
 
-// Entry point, load routes and start server
-func main() {
-	m := pat.New()
-	m.Get("/projects", http.HandlerFunc(listProjects))
-	m.Post("/projects/:projectName", http.HandlerFunc(createProject))
-	m.Get("/projects/:projectName", http.HandlerFunc(showProject))
-	m.Del("/projects/:projectName", http.HandlerFunc(deleteProject))
-	m.Get("/projects/:projectName/queues", http.HandlerFunc(listQueues))
-  m.Post("/projects/:projectName/queues/:queueName", http.HandlerFunc(createQueue))
-  m.Get("/projects/:projectName/queues/:queueName", http.HandlerFunc(showQueue))
-  m.Del("/projects/:projectName/queues/:queueName", http.HandlerFunc(deleteQueue))
-  m.Post("/projects/:projectName/queues/:queueName/clear", http.HandlerFunc(clearQueue))
-  m.Post("/projects/:projectName/queues/:queueName/messages", http.HandlerFunc(addMessages))
-  m.Get("/projects/:projectName/queues/:queueName/messages", http.HandlerFunc(getMessages))
-  m.Post("/projects/:projectName/queues/:queueName/messages/delete", http.HandlerFunc(deleteMessages))
-
-  logger := httpLogger{Handler: m}
-	http.Handle("/", logger)
-	err := http.ListenAndServe(":8000", nil)
-	if err != nil {
-		log.Fatalf("Could not start server: %v", err)
-	}
+  reaperInterval, err := strconv.Atoi(globalSettings["reaperInterval"])
+  if err != nil || reaperInterval <= 0 {
+    log.Fatalf("Invalid reaperInterval setting '%v' (must be a positive number of seconds)", globalSettings["reaperInterval"])
+  }
+  reaperBatchSize, err := strconv.Atoi(globalSettings["reaperBatchSize"])
+  if err != nil || reaperBatchSize <= 0 {
+    log.Fatalf("Invalid reaperBatchSize setting '%v' (must be a positive integer)", globalSettings["reaperBatchSize"])
+  }
+  startReaper(time.Duration(reaperInterval) * time.Second, reaperBatchSize)
+  maxBodySize, err = strconv.Atoi(globalSettings["maxBodySize"])
+  if err != nil || maxBodySize <= 0 {
+    log.Fatalf("Invalid maxBodySize setting '%v' (must be a positive number of bytes)", globalSettings["maxBodySize"])
+  }
+  maxRequestSize, err = strconv.Atoi(globalSettings["maxRequestSize"])
+  if err != nil || maxRequestSize < maxBodySize {
+    log.Fatalf("Invalid maxRequestSize setting '%v' (must be a number of bytes >= maxBodySize)", globalSettings["maxRequestSize"])
+  }
+  if err := startPushers(); err != nil {
+    log.Fatalf("Could not start pushers: %v", err)
+  }
+  window, err := strconv.Atoi(globalSettings["signatureWindow"])
+  if err != nil || window <= 0 {
+    log.Fatalf("Invalid signatureWindow setting '%v' (must be a positive number of seconds)", globalSettings["signatureWindow"])
+  }
+  signatureWindow = time.Duration(window) * time.Second
+  if k := globalSettings["signingSecretsKey"]; k != "" {
+    key, err := hex.DecodeString(k)
+    if err == nil {
+      err = gotcha.SetSigningSecretsKey(key)
+    }
+    if err != nil {
+      log.Fatalf("Invalid signingSecretsKey setting (must be 64 hex digits): %v", err)
+    }
+  }
+  if clientProjects, err = parseClientProjects(globalSettings["tlsClientProjects"]); err != nil {
+    log.Fatalf("Invalid tlsClientProjects setting: %v", err)
+  }
+  if adminToken = globalSettings["adminToken"]; !authEnabled() {
+    count, err := countTokens()
+    if err != nil {
+      log.Fatalf("Could not check for project tokens: %v", err)
+    }
+    if count > 0 {
+      log.Fatalf("API authentication is disabled (no adminToken or tlsClientProjects setting) but %v project tokens exist, set adminToken or tlsClientProjects or delete the tokens", count)
+    }
+    log.Printf("**WARNING: No adminToken or tlsClientProjects setting, API authentication is disabled")
+  }
+  tlsConfig, err := newTLSConfig(globalSettings)
+  if err != nil {
+    log.Fatalf("Invalid TLS settings: %v", err)
+  }
+  if globalSettings["tlsClientCAFile"] == "" && len(clientProjects) > 0 {
+    log.Fatalf("Invalid tlsClientProjects setting: client certificates require tlsClientCAFile")
+  }
+
+  http.Handle("/", newRouter())
+  server := &http.Server{Addr: ":" + globalSettings["port"], TLSConfig: tlsConfig}
+  if tlsConfig != nil {
+    err = server.ListenAndServeTLS("", "")
+  } else {
+    err = server.ListenAndServe()
+  }
+  if err != nil {
+    log.Fatalf("Could not start server: %v", err)
+  }
 }
 
 /*
@@ -221,17 +377,216 @@ func deleteProject(w http.ResponseWriter, req *http.Request) {
   }
 }
 
+/*
+ GET /projects/:projectName/tokens
+
+ List API tokens of given project, token secrets are never returned
+
+ Parameters
+   - none
+
+ Response
+   - code: 200
+   - body (JSON): [{name:"worker", project:"foo", createdAt:"2009-11-10T23:00:00Z", scopes:["consume"], queues:["jobs"]}, ...]
+
+ Not found error
+   - code: 404
+   - body: Project not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func listTokens(w http.ResponseWriter, req *http.Request) {
+  p, err := findProject(w, req)
+  if err != nil {
+    http.Error(w, "Project not found", 404)
+    return
+  }
+  ts, err := p.Tokens()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to load tokens: %v", err), 422)
+    return
+  }
+  infos := make([]gotcha.TokenInfo, 0, len(*ts))
+  for _, t := range *ts {
+    i, err := t.Info()
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Failed to retrieve token details: %v", err), 422)
+      return
+    }
+    infos = append(infos, *i)
+  }
+  sendResponse(w, &infos)
+}
+
+/*
+ POST /projects/:projectName/tokens/:tokenName
+
+ Create new API token with given name granting access to given project
+
+ The token secret is only returned in this response, it must be sent in the
+ Authorization header of requests: "Authorization: Bearer <token>". So is the
+ signing secret used to sign requests instead (see signature.go), it is only
+ returned when the signingSecretsKey setting is set. Tokens created while that
+ setting is not set have no signing secret, signed requests naming them are
+ rejected (401), such tokens must be recreated to sign requests.
+
+ Parameters (Form-Encoded values containing JSON arrays)
+   - scopes: optional, operations the token can be used for, default to
+             ["admin"]:
+             "enqueue": add messages to queues and publish to topics
+             "consume": lease, delete, release, touch and stream messages
+             "admin":   all operations
+             Showing a queue requires any of these scopes
+   - queues: optional, names of queues the token is restricted to (100 max),
+             restricted tokens can only be used on routes of these queues,
+             default to all queues
+
+ Response
+   - code: 201
+   - body (JSON): {name:"worker", project:"foo", createdAt:"2009-11-10T23:00:00Z", scopes:["consume"], queues:["jobs"], token:"9f86d081...",
+                   signingSecret:"60303ae2..."}
+
+ Not found error
+   - code: 404
+   - body: Project not found
+
+ Authentication disabled error (no adminToken or tlsClientProjects setting)
+   - code: 403
+   - body: <Error message>
+
+ Token already exists error
+   - code: 409
+   - body: <Error message>
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func createToken(w http.ResponseWriter, req *http.Request) {
+  p, err := findProject(w, req)
+  if err != nil {
+    http.Error(w, "Project not found", 404)
+    return
+  }
+  if !authEnabled() {
+    http.Error(w, "Tokens cannot be created while API authentication is disabled (no adminToken or tlsClientProjects setting)", 403)
+    return
+  }
+  name := req.URL.Query().Get(":tokenName")
+  if _, err := p.Token(name); err == nil {
+    http.Error(w, fmt.Sprintf("Token '%v' already exists", name), 409)
+    return
+  }
+  var scopes, queues []string
+  if s := req.FormValue("scopes"); s != "" {
+    if err := json.Unmarshal([]byte(s), &scopes); err != nil {
+      http.Error(w, "Badly formed request ('scopes' value contains malformed JSON)", 400)
+      return
+    }
+  }
+  if q := req.FormValue("queues"); q != "" {
+    if err := json.Unmarshal([]byte(q), &queues); err != nil {
+      http.Error(w, "Badly formed request ('queues' value contains malformed JSON)", 400)
+      return
+    }
+  }
+  t, secret, err := gotcha.NewToken(name, p, scopes, queues)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create token: %v", err), 422)
+    return
+  }
+  i, err := t.Info()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to retrieve token details: %v", err), 422)
+    return
+  }
+  i.Secret = secret
+  if signingSecret, err := t.DecryptSigningSecret(); err == nil {
+    i.SigningSecret = signingSecret
+  }
+  w.WriteHeader(201)
+  sendResponse(w, i)
+}
+
+/*
+ DELETE /projects/:projectName/tokens/:tokenName
+
+ Revoke API token with given name, requests using it are rejected right away
+
+ Parameters
+   - none
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Project not found or Token not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func deleteToken(w http.ResponseWriter, req *http.Request) {
+  p, err := findProject(w, req)
+  if err != nil {
+    http.Error(w, "Project not found", 404)
+    return
+  }
+  t, err := p.Token(req.URL.Query().Get(":tokenName"))
+  if err != nil {
+    http.Error(w, "Token not found", 404)
+    return
+  }
+  if err := t.Destroy(); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to delete token: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
 /* 
 POST /projects/:projectName/queues/:queueName
 
- Create new queue with given name in given project, idempotent
+ Create new queue with given name in given project, idempotent: creating a
+ queue that already exists with the same settings does nothing
 
  Parameters
-   - none
+   - ordering: optional, order in which messages are leased, one of:
+               "fifo":     oldest messages first (default)
+               "lifo":     newest messages first
+               "priority": highest priority messages first, then oldest first
+   - maxAttempts: optional, number of times a message can be leased before it
+                  is moved to the dead-letter queue (1000 max), default is 0
+                  (unlimited), requires deadLetterQueue
+   - deadLetterQueue: optional, name of queue in same project that receives
+                      messages leased maxAttempts times, requires maxAttempts
+   - deduplicationWindow: optional, number of seconds (1 day max) during which
+                          messages added with the same deduplicationId are
+                          only enqueued once, default is 300
 
  Response
    - code: 204
    - body: none
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Queue already exists with different settings error
+   - code: 409
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
 */
 func createQueue(w http.ResponseWriter, req *http.Request) {
   if p, err := findProject(w, req); err != nil {
@@ -239,8 +594,29 @@ func createQueue(w http.ResponseWriter, req *http.Request) {
     return
   } else {
     name := req.URL.Query().Get(":queueName")
-    if _, err := gotcha.NewQueue(name, p); err != nil {
-      http.Error(w, fmt.Sprintf("Failed to create queue: %v", err), 422)
+    maxAttempts, err := extractInt(req.FormValue("maxAttempts"), 0, gotcha.MaxMessageAttempts, 0)
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Badly formed request: %v (maxAttempts)", err), 400)
+      return
+    }
+    window, err := extractDuration(req.FormValue("deduplicationWindow"), time.Duration(1) * time.Second,
+      gotcha.MaxDeduplicationWindow, gotcha.DefaultDeduplicationWindow)
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Badly formed request: %v (deduplicationWindow)", err), 400)
+      return
+    }
+    settings := gotcha.QueueSettings{Ordering: req.FormValue("ordering"), MaxAttempts: maxAttempts,
+      DeadLetterQueue: req.FormValue("deadLetterQueue"), DeduplicationWindow: window}
+    if _, err := gotcha.NewQueue(name, p, settings); err != nil {
+      // Queue names are unique in project, creating a queue that exists
+      // (possibly created concurrently) fails
+      if q, lerr := p.Queue(name); lerr != nil {
+        http.Error(w, fmt.Sprintf("Failed to create queue: %v", err), 422)
+      } else if q.HasSettings(settings) {
+        w.WriteHeader(204)
+      } else {
+        http.Error(w, fmt.Sprintf("Queue '%v' already exists with different settings", name), 409)
+      }
     } else {
       w.WriteHeader(204)
     }
@@ -257,7 +633,7 @@ func createQueue(w http.ResponseWriter, req *http.Request) {
 
  Response
    - code: 200
-   - body (JSON): [{name:"foo", size:10, created_at:"2009-11-10 23:00:00 +0000 UTC"}, ...]
+   - body (JSON): [{name:"foo", size:10, ready:5, delayed:3, inFlight:2, expired:2, ordering:"fifo", created_at:"2009-11-10 23:00:00 +0000 UTC"}, ...]
 
  Misc. error
    - code: 422
@@ -294,7 +670,7 @@ func listQueues(w http.ResponseWriter, req *http.Request) {
 
  Response
    - code: 200
-   - body (JSON): {name:"foo", size:10, created_at:"2009-11-10 23:00:00 +0000 UTC"}
+   - body (JSON): {name:"foo", size:10, ready:5, delayed:3, inFlight:2, expired:2, groups:1, ordering:"fifo", created_at:"2009-11-10 23:00:00 +0000 UTC"}
 
  Not found error
    - code: 404
@@ -332,6 +708,10 @@ func showQueue(w http.ResponseWriter, req *http.Request) {
    - code: 404
    - body: Queue not found
 
+ Queue is the dead-letter queue of another queue (delete that queue first)
+   - code: 409
+   - body: <Error message>
+
  Misc error (e.g. lost connection to MongoDB)
    - code: 422
    - body: <Error message>
@@ -340,7 +720,9 @@ func deleteQueue(w http.ResponseWriter, req *http.Request) {
   if q, err := findQueue(w, req); err != nil {
     http.Error(w, "Queue not found", 404)
   } else {
-    if err := q.Destroy(); err != nil {
+    if err := q.Destroy(); err == gotcha.ErrDeadLetterQueueInUse {
+      http.Error(w, fmt.Sprintf("Failed to delete queue: %v", err), 409)
+    } else if err != nil {
       http.Error(w, fmt.Sprintf("Failed to delete queue: %v", err), 422)
     } else {
       w.WriteHeader(204)
@@ -381,27 +763,18 @@ func clearQueue(w http.ResponseWriter, req *http.Request) {
 }
 
 /* 
- POST /projects/:projectName/queues/:queueName/messages
+ POST /projects/:projectName/queues/:queueName/redrive
 
- Add messages to queue (100 max in a single request)
-
- The messages must be set in the "messages" form value serialized in a JSON array
- Each message must be a hash consisting of the following key value pairs:
-   - body:       required, contains the UTF-8 encoded message body
-   - expiresIn:  optional, contains the amount of time the message must be kept
-                 in the queue before it is either read or discarded, default is
-                 7 days
-
- The response contains one id per message in the "ids" header. ids are comma
- separated.
+ Move messages from given dead-letter queue back to the queues they were
+ dead-lettered from
 
- Parameters (Form-Encoded value containing JSON array)
-   - messages: [{body: "...", expiresIn: 6000}, ...]
+ Parameters
+   - count: optional, maximum number of messages to move, default to all
 
  Response
-   - code: 201
-   - header: ids: "12fasd1", ...
-   
+   - code: 200
+   - body (JSON): {redriven: 10}
+
  Not found error
    - code: 404
    - body: Queue not found
@@ -414,102 +787,863 @@ func clearQueue(w http.ResponseWriter, req *http.Request) {
    - code: 422
    - body: <Error message>
 */
-func addMessages(w http.ResponseWriter, req *http.Request) {
+func redriveQueue(w http.ResponseWriter, req *http.Request) {
   q, err := findQueue(w, req)
   if err != nil {
     http.Error(w, "Queue not found", 404)
     return
   }
-  if err := req.ParseForm(); err != nil {
-    http.Error(w, "Badly formed request (invalid form data)", 400)
-    return
-  }
-  messagesJson := req.Form.Get("messages")
-  if messagesJson == "" {
-    http.Error(w, "Badly formed request (no 'messages' form value)", 400)
+  count, err := extractInt(req.FormValue("count"), 1, math.MaxInt32, math.MaxInt32)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (count)", err), 400)
     return
   }
-  messages := make([]map[string]string, 0, 5)
-  err = json.Unmarshal([]byte(messagesJson), &messages)
+  redriven, err := q.RedriveMessages(count)
   if err != nil {
-    http.Error(w, "Badly formed request ('messages' value contains malformed JSON)", 400)
+    http.Error(w, fmt.Sprintf("Failed to redrive messages: %v", err), 422)
     return
   }
-  if len(messages) > MaxEnqueueCount {
-    http.Error(w, fmt.Sprintf("Cannot enqueue more than %v messages in one request", MaxEnqueueCount), 400)
+  sendResponse(w, map[string]int{"redriven": redriven})
+}
+
+/* 
+ GET /projects/:projectName/queues/:queueName/subscribers
+
+ Retrieve all subscribers of given queue
+
+ Parameters
+   - none
+
+ Response
+   - code: 200
+   - body (JSON): [{name:"foo", url:"https://example.com/hook", timeout:10, retryDelay:10, maxRetryDelay:3600, ...}, ...]
+
+ Not found error
+   - code: 404
+   - body: Queue not found
+
+ Misc. error
+   - code: 422
+   - body: <Error message>
+*/
+func listSubscribers(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
     return
   }
-  internalMsgs := make([]*gotcha.Message, 0, len(messages))
-  now := time.Now().UTC()
-  for _, m := range messages {
-    body := m["body"]
-    if body == "" {
-      http.Error(w, "Badly formed request ('messages' contains a message with no 'body' value)", 400)
-      return
-    }
-    expiresIn, err := extractDuration(m["expiresIn"], gotcha.MinMessageExpiry, gotcha.MaxMessageExpiry, gotcha.DefaultMessageExpiry)
-    if err != nil {
-      http.Error(w, fmt.Sprintf("Badly formed request: %v (expiresIn)", err), 400)
-      return
-    }
-    internalMsgs = append(internalMsgs, &gotcha.Message{ID: bson.NewObjectId(), Body: body, QueueID: q.ID, ProjectID: q.ProjectID,
-                                                ExpiresAt: now.Add(expiresIn), CreatedAt: now})
-  }
-  err = gotcha.SaveMessages(&internalMsgs)
+  subs, err := q.Subscribers()
   if err != nil {
-    http.Error(w, fmt.Sprintf("Failed to enqueue messages: %v", err), 422)
+    http.Error(w, fmt.Sprintf("Failed to load subscribers: %v", err), 422)
     return
   }
-  ids := make([]string, 0, len(internalMsgs))
-  for _, m := range internalMsgs {
-    ids = append(ids, m.ID.Hex())
-  }
-  w.Header().Add("ids", strings.Join(ids, ","))
-  w.WriteHeader(201)
-}
-
-// Extract duration from form value
-// If value is nil then use provided default value
-// If value is not an integer then return an error
-// If value is not is the sepcified min/max range then return an error
-func extractDuration(val interface{}, min, max, def time.Duration) (time.Duration, error) {
-  if val == nil || val == "" {
-    return def, nil
-  }
-  intVal := 0
-  switch val.(type) {
-  case int:
-    intVal = val.(int)
-  case string:
-    strVal := val.(string)
-    var err error
-    intVal, err = strconv.Atoi(strVal)
+  infos := make([]gotcha.SubscriberInfo, 0, len(*subs))
+  for _, s := range *subs {
+    i, err := s.Info()
     if err != nil {
-      return time.Duration(0), errors.New(fmt.Sprintf("Invalid duration value '%v'", val))
+      http.Error(w, fmt.Sprintf("Failed to retrieve subscriber details: %v", err), 422)
+      return
     }
+    infos = append(infos, *i)
   }
-  return time.Duration(intVal) * time.Second, nil
+  sendResponse(w, &infos)
 }
 
 /* 
- GET /projects/:projectName/queues/:queueName/messages?count=20&timeout=30
+ POST /projects/:projectName/queues/:queueName/subscribers/:subscriberName
 
- Lease messages from queue (100 max in a single request)
+ Create new subscriber with given name for given queue, the queue becomes a
+ push queue: its messages are POSTed as JSON to its subscribers and deleted
+ once a subscriber responds with a 2xx status code. Subscribers share the
+ load: each message is delivered to a single subscriber, not to all of them.
+ Failed deliveries are retried against the next subscriber (in name order)
+ after a delay that doubles with each attempt of the message, whichever
+ subscribers the previous attempts went to.
 
- The response contains a JSON encoded hash with two key/pairs:
+ Parameters
+   - url: required, absolute http or https URL messages are POSTed to
+   - timeout: optional, maximum duration of delivery requests in seconds (60
+              max), default to 10
+   - retryDelay: optional, delay before first retry in seconds, default to 10
+   - maxRetryDelay: optional, maximum delay between retries in seconds (15
+                    days max), default to 3600
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Queue not found
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. subscriber already exists)
+   - code: 422
+   - body: <Error message>
+*/
+func createSubscriber(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  timeout, err := extractDuration(req.FormValue("timeout"), gotcha.MinSubscriberTimeout, gotcha.MaxSubscriberTimeout, gotcha.DefaultSubscriberTimeout)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (timeout)", err), 400)
+    return
+  }
+  retryDelay, err := extractDuration(req.FormValue("retryDelay"), time.Duration(1) * time.Second, gotcha.MaxMessageDelay, gotcha.DefaultRetryDelay)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (retryDelay)", err), 400)
+    return
+  }
+  maxRetryDelay, err := extractDuration(req.FormValue("maxRetryDelay"), time.Duration(1) * time.Second, gotcha.MaxMessageDelay, gotcha.DefaultMaxRetryDelay)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (maxRetryDelay)", err), 400)
+    return
+  }
+  settings := gotcha.SubscriberSettings{URL: req.FormValue("url"), Timeout: timeout, RetryDelay: retryDelay, MaxRetryDelay: maxRetryDelay}
+  if _, err := gotcha.NewSubscriber(req.URL.Query().Get(":subscriberName"), q, settings); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create subscriber: %v", err), 422)
+    return
+  }
+  startPusher(q)
+  w.WriteHeader(204)
+}
+
+/* 
+ GET /projects/:projectName/queues/:queueName/subscribers/:subscriberName
+
+ Retrieve information about given subscriber
+
+ Parameters
+   - none
+
+ Response
+   - code: 200
+   - body (JSON): {name:"foo", url:"https://example.com/hook", timeout:10, retryDelay:10, maxRetryDelay:3600, ...}
+
+ Not found error
+   - code: 404
+   - body: Subscriber not found
+
+ Misc. error
+   - code: 422
+   - body: <Error message>
+*/
+func showSubscriber(w http.ResponseWriter, req *http.Request) {
+  s, err := findSubscriber(w, req)
+  if err != nil {
+    http.Error(w, "Subscriber not found", 404)
+    return
+  }
+  i, err := s.Info()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to retrieve subscriber details: %v", err), 422)
+    return
+  }
+  sendResponse(w, i)
+}
+
+/* 
+ DELETE /projects/:projectName/queues/:queueName/subscribers/:subscriberName
+
+ Delete given subscriber, messages are no longer pushed once the queue has no
+ subscriber left
+
+ Parameters
+   - none
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Subscriber not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func deleteSubscriber(w http.ResponseWriter, req *http.Request) {
+  s, err := findSubscriber(w, req)
+  if err != nil {
+    http.Error(w, "Subscriber not found", 404)
+    return
+  }
+  if err := s.Destroy(); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to delete subscriber: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ GET /projects/:projectName/topics
+
+ List all topics in given project
+
+ Parameters
+   - none
+
+ Response
+   - code: 200
+   - body (JSON): [{name:"foo", subscriptions:[{queue:"bar", filter:{type:"invoice"}, ...}, ...], ...}, ...]
+
+ Not found error
+   - code: 404
+   - body: Project not found
+
+ Misc. error
+   - code: 422
+   - body: <Error message>
+*/
+func listTopics(w http.ResponseWriter, req *http.Request) {
+  p, err := findProject(w, req)
+  if err != nil {
+    http.Error(w, "Project not found", 404)
+    return
+  }
+  ts, err := p.Topics()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to load topics: %v", err), 422)
+    return
+  }
+  infos := make([]gotcha.TopicInfo, 0, len(*ts))
+  for _, t := range *ts {
+    i, err := t.Info()
+    if err != nil {
+      http.Error(w, fmt.Sprintf("Failed to retrieve topic details: %v", err), 422)
+      return
+    }
+    infos = append(infos, *i)
+  }
+  sendResponse(w, &infos)
+}
+
+/* 
+ POST /projects/:projectName/topics/:topicName
+
+ Create new topic with given name in given project, idempotent
+ Messages published to the topic are enqueued in all queues subscribed to it
+
+ Parameters
+   - none
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Project not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func createTopic(w http.ResponseWriter, req *http.Request) {
+  p, err := findProject(w, req)
+  if err != nil {
+    http.Error(w, "Project not found", 404)
+    return
+  }
+  name := req.URL.Query().Get(":topicName")
+  if _, err := p.Topic(name); err == nil {
+    w.WriteHeader(204)
+    return
+  }
+  if _, err := gotcha.NewTopic(name, p); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to create topic: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ GET /projects/:projectName/topics/:topicName
+
+ Retrieve information about given topic and its subscriptions
+
+ Parameters
+   - none
+
+ Response
+   - code: 200
+   - body (JSON): {name:"foo", subscriptions:[{queue:"bar", filter:{type:"invoice"}, ...}, ...], ...}
+
+ Not found error
+   - code: 404
+   - body: Topic not found
+
+ Misc. error
+   - code: 422
+   - body: <Error message>
+*/
+func showTopic(w http.ResponseWriter, req *http.Request) {
+  t, err := findTopic(w, req)
+  if err != nil {
+    http.Error(w, "Topic not found", 404)
+    return
+  }
+  i, err := t.Info()
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to retrieve topic details: %v", err), 422)
+    return
+  }
+  sendResponse(w, i)
+}
+
+/* 
+ DELETE /projects/:projectName/topics/:topicName
+
+ Delete given topic and its subscriptions, subscribed queues and their
+ messages are left untouched
+
+ Parameters
+   - none
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Topic not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func deleteTopic(w http.ResponseWriter, req *http.Request) {
+  t, err := findTopic(w, req)
+  if err != nil {
+    http.Error(w, "Topic not found", 404)
+    return
+  }
+  if err := t.Destroy(); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to delete topic: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ POST /projects/:projectName/topics/:topicName/subscriptions/:queueName
+
+ Subscribe queue to topic, the queue must belong to the same project
+ Subscribing an already subscribed queue replaces its filter
+
+ Messages published to the topic are only enqueued if their attributes
+ contain all the key/value pairs of the filter, messages are always
+ enqueued if there is no filter.
+
+ Parameters (Form-Encoded value containing JSON hash)
+   - filter: optional, attributes messages must have, e.g. {"type":"invoice"}
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Topic not found or Queue not found
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. maximum number of subscriptions reached)
+   - code: 422
+   - body: <Error message>
+*/
+func subscribeQueue(w http.ResponseWriter, req *http.Request) {
+  t, err := findTopic(w, req)
+  if err != nil {
+    http.Error(w, "Topic not found", 404)
+    return
+  }
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  var filter map[string]string
+  if filterJson := req.FormValue("filter"); filterJson != "" {
+    if err := json.Unmarshal([]byte(filterJson), &filter); err != nil {
+      http.Error(w, "Badly formed request ('filter' value contains malformed JSON)", 400)
+      return
+    }
+  }
+  if _, err := t.Subscribe(q, filter); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to subscribe queue: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ DELETE /projects/:projectName/topics/:topicName/subscriptions/:queueName
+
+ Unsubscribe queue from topic, messages already enqueued are left untouched
+
+ Parameters
+   - none
+
+ Response
+   - code: 204
+   - body: none
+
+ Not found error
+   - code: 404
+   - body: Topic not found or Queue not found or Subscription not found
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func unsubscribeQueue(w http.ResponseWriter, req *http.Request) {
+  t, err := findTopic(w, req)
+  if err != nil {
+    http.Error(w, "Topic not found", 404)
+    return
+  }
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  s, err := t.Subscription(q)
+  if err != nil {
+    http.Error(w, "Subscription not found", 404)
+    return
+  }
+  if err := s.Destroy(); err != nil {
+    http.Error(w, fmt.Sprintf("Failed to unsubscribe queue: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ POST /projects/:projectName/topics/:topicName/messages
+
+ Publish messages to topic (100 max in a single request)
+
+ A copy of each message is enqueued in every subscribed queue whose filter
+ matches the message attributes. Copies are saved atomically: either all
+ subscribed queues get their copies or none do.
+
+ Messages are given in the "messages" form value with the same format as
+ POST .../queues/:queueName/messages, message attributes are matched against
+ the filters of subscriptions. Priorities are ignored by queues that do not
+ use "priority" ordering.
+
+ Parameters (Form-Encoded value containing JSON array)
+   - messages: [{body: "...", attributes: {type: "invoice"}, expiresIn: 6000}, ...]
+
+ Response
+   - code: 201
+   - body (JSON): ids of enqueued copies indexed by queue name
+                  {invoices:["12fasd1", ...], audit:["12fasd2", ...]}
+
+ Not found error
+   - code: 404
+   - body: Topic not found
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Request or message body too large error
+   - code: 413
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func publishMessages(w http.ResponseWriter, req *http.Request) {
+  t, err := findTopic(w, req)
+  if err != nil {
+    http.Error(w, "Topic not found", 404)
+    return
+  }
+  messages, err := extractMessages(w, req)
+  if err != nil {
+    http.Error(w, err.Error(), extractErrorCode(err))
+    return
+  }
+  ids, err := t.Publish(messages)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to publish messages: %v", err), 422)
+    return
+  }
+  w.WriteHeader(201)
+  sendResponse(w, ids)
+}
+
+/* 
+ POST /projects/:projectName/queues/:queueName/messages
+
+ Add messages to queue (100 max in a single request)
+
+ The messages must be set in the "messages" form value serialized in a JSON array
+ Each message must be a hash consisting of the following key value pairs:
+   - body:       required, contains the UTF-8 encoded message body or the
+                 base64 encoded body if encoding is "base64"
+   - encoding:   optional, "base64" for binary bodies, bodies are UTF-8
+                 text by default
+   - expiresIn:  optional, contains the amount of time the message must be kept
+                 in the queue before it is either read or discarded, default is
+                 7 days
+   - priority:   optional, integer between -100 and 100, messages with higher
+                 priorities are leased first, default is 0. Only allowed for
+                 queues created with "priority" ordering
+   - delay:      optional, number of seconds (15 days max) before the message
+                 can be leased, default is 0
+   - visibleAt:  optional, RFC 3339 timestamp before which the message cannot
+                 be leased, cannot be used together with delay
+   - attributes: optional, hash of string attributes returned with the message
+                 and usable to filter leased messages (16 attributes and 4KB
+                 max), names may only contain letters, digits, '-' and '_'
+   - deduplicationId: optional, up to 128 characters, messages added with the
+                      same deduplicationId within the queue deduplication
+                      window are only enqueued once, the id of the message
+                      that was enqueued is returned for the duplicates
+   - groupId:    optional, up to 128 characters, messages of a group are
+                 leased one at a time in the order they were added: a message
+                 cannot be leased until all older messages of its group are
+                 deleted or expired
+
+ The response contains one id per message in the "ids" header. ids are comma
+ separated.
+
+ Parameters (Form-Encoded value containing JSON array)
+   - messages: [{body: "...", expiresIn: 6000, priority: 10, delay: 30, attributes: {type: "invoice"}}, ...]
+
+ Alternatively a single binary message can be added by sending its raw body
+ with the "application/octet-stream" content type (parameters such as
+ charset are ignored), the other message values
+ are then given in the query string with attributes as attr.<name>=<value>:
+   POST .../messages?expiresIn=6000&attr.type=invoice
+
+ Message bodies are limited to 256KB and requests to 1MB by default (see
+ maxBodySize and maxRequestSize settings), leased binary messages have a
+ base64 encoded body and an "encoding" value of "base64".
+
+ Response
+   - code: 201
+   - header: ids: "12fasd1", ...
+   
+ Not found error
+   - code: 404
+   - body: Queue not found
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Request or message body too large error
+   - code: 413
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func addMessages(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  internalMsgs, err := extractMessages(w, req)
+  if err != nil {
+    http.Error(w, err.Error(), extractErrorCode(err))
+    return
+  }
+  for _, m := range internalMsgs {
+    if m.Priority != 0 && q.Ordering != gotcha.OrderPriority {
+      http.Error(w, fmt.Sprintf("Badly formed request (queue '%v' does not use '%v' ordering, messages cannot have a priority)", q.Name, gotcha.OrderPriority), 400)
+      return
+    }
+    m.QueueID, m.ProjectID = q.ID, q.ProjectID
+  }
+  err = gotcha.SaveMessages(&internalMsgs)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to enqueue messages: %v", err), 422)
+    return
+  }
+  ids := make([]string, 0, len(internalMsgs))
+  for _, m := range internalMsgs {
+    ids = append(ids, m.ID.Hex())
+  }
+  w.Header().Add("ids", strings.Join(ids, ","))
+  w.WriteHeader(201)
+}
+
+// Message parameters accepted by addMessages and publishMessages
+// Numeric values may be given as JSON numbers or strings
+type messageParams struct {
+  Body            string            `json:"body"`
+  ExpiresIn       interface{}       `json:"expiresIn"`
+  Priority        interface{}       `json:"priority"`
+  Delay           interface{}       `json:"delay"`
+  VisibleAt       string            `json:"visibleAt"`
+  Attributes      map[string]string `json:"attributes"`
+  Encoding        string            `json:"encoding"`
+  DeduplicationID string            `json:"deduplicationId"`
+  GroupID         string            `json:"groupId"`
+  raw             []byte            // Body of binary message sent as raw request body
+}
+
+// Maximum length of message deduplication ids
+const MaxDeduplicationIDLength = 128
+
+// Maximum length of message group ids
+const MaxGroupIDLength = 128
+
+// Error caused by a request or message body exceeding size limits
+type tooLargeError string
+
+func (e tooLargeError) Error() string { return string(e) }
+
+// HTTP status code for errors returned by extractMessages
+func extractErrorCode(err error) int {
+  if _, ok := err.(tooLargeError); ok {
+    return 413
+  }
+  return 400
+}
+
+// Extract messages from "messages" form value or from raw request body
+// Returned messages have an id but no queue or project
+// Return a tooLargeError if the request or a message body is too large, error
+// messages are suitable for 400 responses otherwise
+func extractMessages(w http.ResponseWriter, req *http.Request) ([]*gotcha.Message, error) {
+  tooLarge := tooLargeError(fmt.Sprintf("Request is too large (%v bytes max)", maxRequestSize))
+  if req.ContentLength > int64(maxRequestSize) {
+    return nil, tooLarge
+  }
+  req.Body = http.MaxBytesReader(w, req.Body, int64(maxRequestSize))
+  messages := make([]messageParams, 0, 5)
+  if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/octet-stream" {
+    raw, err := ioutil.ReadAll(req.Body)
+    if err != nil {
+      if _, ok := err.(*http.MaxBytesError); ok {
+        return nil, tooLarge
+      }
+      return nil, errors.New("Badly formed request (could not read body)")
+    }
+    query := req.URL.Query()
+    messages = append(messages, messageParams{ExpiresIn: query.Get("expiresIn"), Priority: query.Get("priority"),
+      Delay: query.Get("delay"), VisibleAt: query.Get("visibleAt"), Attributes: extractAttributes(query),
+      DeduplicationID: query.Get("deduplicationId"), GroupID: query.Get("groupId"), raw: raw})
+  } else {
+    if err := req.ParseForm(); err != nil {
+      if _, ok := err.(*http.MaxBytesError); ok {
+        return nil, tooLarge
+      }
+      return nil, errors.New("Badly formed request (invalid form data)")
+    }
+    messagesJson := req.Form.Get("messages")
+    if messagesJson == "" {
+      return nil, errors.New("Badly formed request (no 'messages' form value)")
+    }
+    if err := json.Unmarshal([]byte(messagesJson), &messages); err != nil {
+      return nil, errors.New("Badly formed request ('messages' value contains malformed JSON)")
+    }
+  }
+  if len(messages) > MaxEnqueueCount {
+    return nil, errors.New(fmt.Sprintf("Cannot enqueue more than %v messages in one request", MaxEnqueueCount))
+  }
+  internalMsgs := make([]*gotcha.Message, 0, len(messages))
+  now := time.Now().UTC()
+  for _, m := range messages {
+    body, binary, err := m.body()
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: %v (body)", err))
+    }
+    if len(body) == 0 {
+      return nil, errors.New("Badly formed request ('messages' contains a message with no 'body' value)")
+    }
+    if len(body) > maxBodySize {
+      return nil, tooLargeError(fmt.Sprintf("Message body is too large (%v bytes max)", maxBodySize))
+    }
+    expiresIn, err := extractDuration(m.ExpiresIn, gotcha.MinMessageExpiry, gotcha.MaxMessageExpiry, gotcha.DefaultMessageExpiry)
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: %v (expiresIn)", err))
+    }
+    priority, err := extractInt(m.Priority, gotcha.MinMessagePriority, gotcha.MaxMessagePriority, 0)
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: %v (priority)", err))
+    }
+    visibleAt, err := extractVisibleAt(&m, now, now.Add(expiresIn))
+    if err != nil {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: %v", err))
+    }
+    if err := gotcha.ValidateAttributes(m.Attributes); err != nil {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: %v (attributes)", err))
+    }
+    if len(m.DeduplicationID) > MaxDeduplicationIDLength {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: deduplication id is too long (%v characters max)", MaxDeduplicationIDLength))
+    }
+    if len(m.GroupID) > MaxGroupIDLength {
+      return nil, errors.New(fmt.Sprintf("Badly formed request: group id is too long (%v characters max)", MaxGroupIDLength))
+    }
+    internalMsgs = append(internalMsgs, &gotcha.Message{ID: bson.NewObjectId(), Body: body, Binary: binary,
+                                                ExpiresAt: now.Add(expiresIn), CreatedAt: now, Priority: priority,
+                                                VisibleAt: visibleAt, LeaseExpiresAt: visibleAt, Attributes: m.Attributes,
+                                                DeduplicationID: m.DeduplicationID, GroupID: m.GroupID})
+  }
+  return internalMsgs, nil
+}
+
+// Decode message body, return whether it is binary
+func (m *messageParams) body() ([]byte, bool, error) {
+  if m.raw != nil {
+    return m.raw, true, nil
+  }
+  switch m.Encoding {
+  case "":
+    return []byte(m.Body), false, nil
+  case "base64":
+    b, err := base64.StdEncoding.DecodeString(m.Body)
+    if err != nil {
+      return nil, false, errors.New("Invalid base64 value")
+    }
+    return b, true, nil
+  }
+  return nil, false, errors.New(fmt.Sprintf("Unknown encoding '%v' (must be empty or 'base64')", m.Encoding))
+}
+
+// Extract attributes given as attr.<name>=<value> query values
+func extractAttributes(query url.Values) map[string]string {
+  attrs := make(map[string]string)
+  for k, v := range query {
+    if strings.HasPrefix(k, "attr.") {
+      attrs[k[len("attr."):]] = v[0]
+    }
+  }
+  return attrs
+}
+
+// Extract duration from form value
+// If value is nil then use provided default value
+// If value is not an integer then return an error
+// If value is not is the sepcified min/max range then return an error
+func extractDuration(val interface{}, min, max, def time.Duration) (time.Duration, error) {
+  if val == nil || val == "" {
+    return def, nil
+  }
+  secs, err := extractInt(val, int(min.Seconds()), int(max.Seconds()), 0)
+  if err != nil {
+    return time.Duration(0), errors.New(fmt.Sprintf("Invalid duration value '%v' (must be an integer number of seconds >= %v and <= %v)", val, int(min.Seconds()), int(max.Seconds())))
+  }
+  return time.Duration(secs) * time.Second, nil
+}
+
+// Extract timestamp at which message becomes visible from 'delay' or 'visibleAt'
+// Return zero time if message is not delayed
+// Return an error if both are set or if message would expire before becoming visible
+func extractVisibleAt(m *messageParams, now, expiresAt time.Time) (time.Time, error) {
+  var visibleAt time.Time
+  if m.VisibleAt != "" {
+    if m.Delay != nil && m.Delay != "" {
+      return visibleAt, errors.New("message cannot have both 'delay' and 'visibleAt' values")
+    }
+    t, err := time.Parse(time.RFC3339, m.VisibleAt)
+    if err != nil {
+      return visibleAt, errors.New(fmt.Sprintf("Invalid timestamp '%v' (must be RFC 3339) (visibleAt)", m.VisibleAt))
+    }
+    if t.After(now.Add(gotcha.MaxMessageDelay)) {
+      return visibleAt, errors.New(fmt.Sprintf("Timestamp '%v' is too far in the future (visibleAt)", m.VisibleAt))
+    }
+    if t.After(now) {
+      visibleAt = t.UTC()
+    }
+  } else {
+    delay, err := extractDuration(m.Delay, time.Duration(0), gotcha.MaxMessageDelay, time.Duration(0))
+    if err != nil {
+      return visibleAt, errors.New(fmt.Sprintf("%v (delay)", err))
+    }
+    if delay > 0 {
+      visibleAt = now.Add(delay)
+    }
+  }
+  if !visibleAt.IsZero() && !visibleAt.Before(expiresAt) {
+    return visibleAt, errors.New("message would expire before becoming visible (delay or visibleAt must be before expiresIn)")
+  }
+  return visibleAt, nil
+}
+
+// Extract integer from form or JSON value
+// If value is nil then use provided default value
+// If value is not an integer then return an error
+// If value is not is the sepcified min/max range then return an error
+func extractInt(val interface{}, min, max, def int) (int, error) {
+  if val == nil || val == "" {
+    return def, nil
+  }
+  intVal := 0
+  switch v := val.(type) {
+  case int:
+    intVal = v
+  case float64: // JSON numbers
+    if v != float64(int(v)) {
+      return 0, errors.New(fmt.Sprintf("Invalid integer value '%v'", val))
+    }
+    intVal = int(v)
+  case string:
+    var err error
+    intVal, err = strconv.Atoi(v)
+    if err != nil {
+      return 0, errors.New(fmt.Sprintf("Invalid integer value '%v'", val))
+    }
+  default:
+    return 0, errors.New(fmt.Sprintf("Invalid integer value '%v'", val))
+  }
+  if intVal < min || intVal > max {
+    return 0, errors.New(fmt.Sprintf("Value %v out of range (must be >= %v and <= %v)", intVal, min, max))
+  }
+  return intVal, nil
+}
+
+/* 
+ GET /projects/:projectName/queues/:queueName/messages?count=20&timeout=30&wait=10&attr.type=invoice
+
+ Lease messages from queue (100 max in a single request)
+
+ The response contains a JSON encoded hash with two key/pairs:
    - messages: Contains actual messages, details below
    - timeout:  Timeout value specified in GET request if any
 
  Each message is a hash consisting of the following key value pairs:
    - id:         Unique message id
-   - body:       UTF-8 encoded message body
+   - body:       UTF-8 encoded message body, base64 encoded if the message
+                 was added with a binary body
+   - encoding:   "base64" if body is base64 encoded, absent otherwise
    - timeout:    Maximum amount of time the message can be leased before 
                  it is put back in the queue
+   - attempts:   Number of times the message was leased, including this one
+   - receipt:    Receipt of this lease, required to delete or touch the message
+   - attributes: Attributes set when the message was added, if any
+   - groupId:    Group of the message, if any
 
  Parameters (Form-Encoded array containing JSON data)
  - count: optional, Number of messages to lease (100 max), default to 1
  - timeout: optional, Lease timeout, messages that are not deleted before timeout
             get placed back in queue, default to value specified when enqueueing
+ - wait: optional, Number of seconds to wait for messages if queue is empty
+         (30 max), the response is sent as soon as messages are added to the
+         queue, default to 0 (respond right away)
+ - attr.<name>: optional, only lease messages whose attribute <name> is equal
+                to the given value, several attributes may be given
 
  Response
    - code: 201
@@ -549,7 +1683,22 @@ func getMessages(w http.ResponseWriter, req *http.Request) {
     http.Error(w, fmt.Sprintf("Invalid timeout value '%v' (must be an integer <= %v >= %v)", timeout, MaxMessageTimeout.Seconds(), MinMessageTimeout.Seconds()), 400)
     return
   }
-  messages, err := q.LeaseMessages(count, timeout)
+  wait, err := extractDuration(req.URL.Query().Get("wait"), time.Duration(0), MaxLeaseWait, time.Duration(0))
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (wait)", err), 400)
+    return
+  }
+  filter := extractAttributes(req.URL.Query())
+  if err := gotcha.ValidateAttributes(filter); err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (attr)", err), 400)
+    return
+  }
+  var messages *[]gotcha.MessageInfo
+  if wait > 0 {
+    messages, err = q.WaitMessages(count, timeout, wait, filter, req.Context().Done())
+  } else {
+    messages, err = q.LeaseMessages(count, timeout, filter)
+  }
   if err != nil {
     http.Error(w, fmt.Sprintf("Failed to lease messages (%v)", err), 400)
     return
@@ -570,9 +1719,12 @@ func getMessages(w http.ResponseWriter, req *http.Request) {
  Delete messages from queue
 
  ids should be be in a JSON encoded array in the "messageIds" form value
+ receipts returned when leasing the messages should be in a JSON encoded
+ array in the "receipts" form value, in the same order as the ids
 
  Parameters (Form-Encoded array containing JSON data)
  - messageIds: required, Ids of messages to be deleted
+ - receipts: required, Receipts of messages to be deleted
 
  Response
    - code: 204
@@ -580,7 +1732,11 @@ func getMessages(w http.ResponseWriter, req *http.Request) {
    
  Not found error
    - code: 404
-   - body: Queue not found
+   - body: Queue not found or Message not found
+
+ Invalid receipt error (message was leased again since)
+   - code: 409
+   - body: <Error message>
 
  Badly formed request error
    - code: 400
@@ -596,27 +1752,185 @@ func deleteMessages(w http.ResponseWriter, req *http.Request) {
     http.Error(w, "Queue not found", 404)
     return
   }
-  if err := req.ParseForm(); err != nil {
-    http.Error(w, "Badly formed request (invalid form data)", 400)
+  messageIds, receipts, err := extractReceipts(req)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request (%v)", err), 400)
+    return
+  }
+  err = q.DeleteMessages(messageIds, receipts)
+  if err == gotcha.ErrNotFound {
+    http.Error(w, "Message not found", 404)
+    return
+  } else if err == gotcha.ErrInvalidReceipt {
+    http.Error(w, "Could not delete all messages: invalid receipt, message was leased again", 409)
+    return
+  } else if err != nil {
+    http.Error(w, fmt.Sprintf("Could not delete all messages: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+/* 
+ POST /projects/:projectName/queues/:queueName/messages/release
+
+ Put leased messages back in queue without waiting for their lease to expire
+
+ ids and receipts are given as for deleting messages, see above
+ Released messages can be leased again once the optional delay has elapsed,
+ they keep their number of attempts.
+
+ Parameters (Form-Encoded array containing JSON data)
+ - messageIds: required, Ids of messages to be released
+ - receipts: required, Receipts of messages to be released
+ - delay: optional, Number of seconds before messages can be leased again
+          (15 days max), default to 0
+
+ Response
+   - code: 204
+   - header: none
+
+ Not found error
+   - code: 404
+   - body: Queue not found or Message not found
+
+ Lease expired or invalid receipt error
+   - code: 409
+   - body: <Error message>
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func releaseMessages(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  messageIds, receipts, err := extractReceipts(req)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request (%v)", err), 400)
+    return
+  }
+  delay, err := extractDuration(req.Form.Get("delay"), time.Duration(0), gotcha.MaxMessageDelay, time.Duration(0))
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (delay)", err), 400)
+    return
+  }
+  err = q.ReleaseMessages(messageIds, receipts, delay)
+  if err == gotcha.ErrNotFound {
+    http.Error(w, "Message not found", 404)
     return
+  } else if err == gotcha.ErrLeaseExpired {
+    http.Error(w, "Could not release all messages: message lease has expired", 409)
+    return
+  } else if err == gotcha.ErrInvalidReceipt {
+    http.Error(w, "Could not release all messages: invalid receipt, message was leased again", 409)
+    return
+  } else if err != nil {
+    http.Error(w, fmt.Sprintf("Could not release all messages: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+// Extract JSON encoded message ids and receipts from "messageIds" and
+// "receipts" form values
+func extractReceipts(req *http.Request) (*[]string, *[]string, error) {
+  if err := req.ParseForm(); err != nil {
+    return nil, nil, errors.New("invalid form data")
   }
   messageIdsJson := req.Form.Get("messageIds")
   if messageIdsJson == "" {
-    http.Error(w, "Badly formed request (no 'messageIds' form value)", 400)
-    return
+    return nil, nil, errors.New("no 'messageIds' form value")
   }
   messageIds := make([]string, 0)
-  err = json.Unmarshal([]byte(messageIdsJson), &messageIds)
+  if err := json.Unmarshal([]byte(messageIdsJson), &messageIds); err != nil {
+    return nil, nil, errors.New("'messageIds' value contains malformed JSON")
+  }
+  receiptsJson := req.Form.Get("receipts")
+  if receiptsJson == "" {
+    return nil, nil, errors.New("no 'receipts' form value")
+  }
+  receipts := make([]string, 0)
+  if err := json.Unmarshal([]byte(receiptsJson), &receipts); err != nil {
+    return nil, nil, errors.New("'receipts' value contains malformed JSON")
+  }
+  if len(receipts) != len(messageIds) {
+    return nil, nil, errors.New("'receipts' and 'messageIds' must have the same length")
+  }
+  return &messageIds, &receipts, nil
+}
+
+/* 
+ POST /projects/:projectName/queues/:queueName/messages/:messageId/touch
+
+ Extend lease of message so that it expires 'timeout' seconds from now
+
+ The message must still be leased, touching a message whose lease expired
+ fails.
+
+ Parameters
+ - receipt: required, receipt returned when leasing the message
+ - timeout: optional, new lease timeout in seconds (24 hours max), default to
+            60 seconds
+
+ Response
+   - code: 200
+   - body (JSON): {id:"12fasd1", leaseExpiresAt:"2009-11-10 23:00:00 +0000 UTC", ...}
+
+ Not found error
+   - code: 404
+   - body: Queue not found or Message not found
+
+ Lease expired or invalid receipt error
+   - code: 409
+   - body: <Error message>
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func touchMessage(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
   if err != nil {
-    http.Error(w, "Badly formed request ('messageIds' value contains malformed JSON)", 400)
+    http.Error(w, "Queue not found", 404)
     return
   }
-  err = q.DeleteMessages(&messageIds)
+  timeout, err := extractDuration(req.FormValue("timeout"), MinMessageTimeout, MaxMessageTimeout, DefaultMessageTimeout)
   if err != nil {
-    http.Error(w, fmt.Sprintf("Could not delete all messages: %v", err), 422)
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (timeout)", err), 400)
     return
   }
-  w.WriteHeader(204)
+  receipt := req.FormValue("receipt")
+  if receipt == "" {
+    http.Error(w, "Badly formed request (no 'receipt' value)", 400)
+    return
+  }
+  info, err := q.TouchMessage(req.URL.Query().Get(":messageId"), receipt, timeout)
+  if err == gotcha.ErrNotFound {
+    http.Error(w, "Message not found", 404)
+    return
+  } else if err == gotcha.ErrLeaseExpired {
+    http.Error(w, "Message lease has expired", 409)
+    return
+  } else if err == gotcha.ErrInvalidReceipt {
+    http.Error(w, "Invalid receipt, message was leased again", 409)
+    return
+  } else if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to extend message lease: %v", err), 422)
+    return
+  }
+  sendResponse(w, info)
 }
 
 // Helper method to send document or error in http response
@@ -652,3 +1966,31 @@ func findQueue(w http.ResponseWriter, req *http.Request) (*gotcha.Queue, error)
   }
   return q, nil
 }
+
+// Helper method to find subscriber and return error if not found
+func findSubscriber(w http.ResponseWriter, req *http.Request) (*gotcha.Subscriber, error) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    return nil, err
+  }
+  name := req.URL.Query().Get(":subscriberName")
+  s, err := q.Subscriber(name)
+  if err != nil {
+    return nil, errors.New(fmt.Sprintf("Subscriber with name '%v' not found", name))
+  }
+  return s, nil
+}
+
+// Helper method to find topic and return error if not found
+func findTopic(w http.ResponseWriter, req *http.Request) (*gotcha.Topic, error) {
+  p, err := findProject(w, req)
+  if err != nil {
+    return nil, err
+  }
+  name := req.URL.Query().Get(":topicName")
+  t, err := p.Topic(name)
+  if err != nil {
+    return nil, errors.New(fmt.Sprintf("Topic with name '%v' not found", name))
+  }
+  return t, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+  "encoding/json"
+  "gotcha"
+  "io/ioutil"
+  "labix.org/v2/mgo/bson"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// Start test server backed by an empty in-memory store with authentication
+// disabled
+func newTestServer(t *testing.T) *httptest.Server {
+  gotcha.Storage = gotcha.NewMemoryStore()
+  adminToken, clientProjects = "", make(map[string]string)
+  srv := httptest.NewServer(newRouter())
+  t.Cleanup(srv.Close)
+  return srv
+}
+
+// Send request with given form values, return response code, body and headers
+func request(t *testing.T, srv *httptest.Server, method, path string, form url.Values) (int, string, http.Header) {
+  req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if form != nil {
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  }
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer res.Body.Close()
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return res.StatusCode, string(body), res.Header
+}
+
+// Send request and fail test unless response has given code, return body
+func expect(t *testing.T, srv *httptest.Server, code int, method, path string, form url.Values) string {
+  t.Helper()
+  c, body, _ := request(t, srv, method, path, form)
+  if c != code {
+    t.Fatalf("%v %v: expected %v, got %v (%v)", method, path, code, c, strings.TrimSpace(body))
+  }
+  return body
+}
+
+// Lease messages from queue "q" of project "p"
+func lease(t *testing.T, srv *httptest.Server, query string) []gotcha.MessageInfo {
+  t.Helper()
+  var messages []gotcha.MessageInfo
+  body := expect(t, srv, 200, "GET", "/projects/p/queues/q/messages?"+query, nil)
+  if err := json.Unmarshal([]byte(body), &messages); err != nil {
+    t.Fatalf("Invalid lease response '%v': %v", body, err)
+  }
+  return messages
+}
+
+// Form values identifying leased messages for the delete and release routes
+func leased(messages ...gotcha.MessageInfo) url.Values {
+  ids, receipts := []string{}, []string{}
+  for _, m := range messages {
+    ids, receipts = append(ids, m.ID.Hex()), append(receipts, m.Receipt)
+  }
+  idsJson, _ := json.Marshal(ids)
+  receiptsJson, _ := json.Marshal(receipts)
+  return url.Values{"messageIds": {string(idsJson)}, "receipts": {string(receiptsJson)}}
+}
+
+// Load info of queue "q" of project "p"
+func queueInfo(t *testing.T, srv *httptest.Server) gotcha.QueueInfo {
+  t.Helper()
+  var info gotcha.QueueInfo
+  body := expect(t, srv, 200, "GET", "/projects/p/queues/q", nil)
+  if err := json.Unmarshal([]byte(body), &info); err != nil {
+    t.Fatalf("Invalid queue response '%v': %v", body, err)
+  }
+  return info
+}
+
+func TestCreateProjectAndQueue(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 404, "POST", "/projects/nope/queues/q", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", url.Values{"ordering": {"lifo"}})
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", url.Values{"ordering": {"lifo"}})
+  expect(t, srv, 409, "POST", "/projects/p/queues/q", url.Values{"ordering": {"fifo"}})
+  if info := queueInfo(t, srv); info.Name != "q" || info.ProjectName != "p" || info.Ordering != "lifo" || info.Size != 0 {
+    t.Fatalf("Unexpected queue info %+v", info)
+  }
+  var queues []gotcha.QueueInfo
+  json.Unmarshal([]byte(expect(t, srv, 200, "GET", "/projects/p/queues", nil)), &queues)
+  if len(queues) != 1 || queues[0].Name != "q" {
+    t.Fatalf("Unexpected queues %+v", queues)
+  }
+}
+
+func TestDeleteDeadLetterQueue(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/dlq", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", url.Values{"maxAttempts": {"3"}, "deadLetterQueue": {"dlq"}})
+  expect(t, srv, 409, "DELETE", "/projects/p/queues/dlq", nil)
+  expect(t, srv, 204, "DELETE", "/projects/p/queues/q", nil)
+  expect(t, srv, 204, "DELETE", "/projects/p/queues/dlq", nil)
+
+  // Deleting the project deletes queues regardless of references
+  expect(t, srv, 204, "POST", "/projects/p/queues/dlq", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", url.Values{"maxAttempts": {"3"}, "deadLetterQueue": {"dlq"}})
+  expect(t, srv, 204, "DELETE", "/projects/p", nil)
+  expect(t, srv, 404, "GET", "/projects/p/queues/dlq", nil)
+}
+
+func TestMessageLifecycle(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  _, _, header := request(t, srv, "POST", "/projects/p/queues/q/messages", url.Values{"messages": {`[{"body":"a"},{"body":"b"}]`}})
+  ids := strings.Split(header.Get("ids"), ",")
+  if len(ids) != 2 {
+    t.Fatalf("Unexpected ids header '%v'", header.Get("ids"))
+  }
+  if info := queueInfo(t, srv); info.Size != 2 || info.Ready != 2 {
+    t.Fatalf("Unexpected queue info %+v", info)
+  }
+
+  ms := lease(t, srv, "count=2&timeout=60")
+  if len(ms) != 2 || ms[0].Body != "a" || ms[1].Body != "b" || ms[0].ID.Hex() != ids[0] || ms[0].Attempts != 1 {
+    t.Fatalf("Unexpected leased messages %+v", ms)
+  }
+  if more := lease(t, srv, "count=2"); len(more) != 0 {
+    t.Fatalf("Leased messages were leased again: %+v", more)
+  }
+  if info := queueInfo(t, srv); info.InFlight != 2 || info.Ready != 0 {
+    t.Fatalf("Unexpected queue info %+v", info)
+  }
+
+  // Touch extends the lease
+  var touched gotcha.MessageInfo
+  body := expect(t, srv, 200, "POST", "/projects/p/queues/q/messages/"+ms[0].ID.Hex()+"/touch", url.Values{"receipt": {ms[0].Receipt}, "timeout": {"120"}})
+  json.Unmarshal([]byte(body), &touched)
+  if !touched.LeaseExpiresAt.After(ms[0].LeaseExpiresAt) {
+    t.Fatalf("Touch did not extend lease: %v then %v", ms[0].LeaseExpiresAt, touched.LeaseExpiresAt)
+  }
+  expect(t, srv, 409, "POST", "/projects/p/queues/q/messages/"+ms[0].ID.Hex()+"/touch", url.Values{"receipt": {"bogus"}})
+  expect(t, srv, 404, "POST", "/projects/p/queues/q/messages/"+bson.NewObjectId().Hex()+"/touch", url.Values{"receipt": {ms[0].Receipt}})
+
+  // Delete the first message, release the second one
+  expect(t, srv, 204, "POST", "/projects/p/queues/q/messages/delete", leased(ms[0]))
+  expect(t, srv, 204, "POST", "/projects/p/queues/q/messages/release", leased(ms[1]))
+  expect(t, srv, 404, "POST", "/projects/p/queues/q/messages/delete", leased(ms[0]))
+  again := lease(t, srv, "count=2")
+  if len(again) != 1 || again[0].Body != "b" || again[0].Attempts != 2 || again[0].Receipt == ms[1].Receipt {
+    t.Fatalf("Unexpected released messages %+v", again)
+  }
+  expect(t, srv, 409, "POST", "/projects/p/queues/q/messages/delete", leased(ms[1]))
+  expect(t, srv, 204, "POST", "/projects/p/queues/q/messages/delete", leased(again[0]))
+  if info := queueInfo(t, srv); info.Size != 0 {
+    t.Fatalf("Unexpected queue info %+v", info)
+  }
+}
+
+func TestBinaryMessages(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  res, err := http.Post(srv.URL+"/projects/p/queues/q/messages?attr.type=raw", "application/octet-stream; charset=binary",
+    strings.NewReader("\x00\xff"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  res.Body.Close()
+  if res.StatusCode != 201 {
+    t.Fatalf("Failed to add binary message: %v", res.StatusCode)
+  }
+  ms := lease(t, srv, "")
+  if len(ms) != 1 || ms[0].Body != "AP8=" || ms[0].Encoding != "base64" || ms[0].Attributes["type"] != "raw" {
+    t.Fatalf("Unexpected leased messages %+v", ms)
+  }
+}
+
+func TestLeaseExpiry(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  expect(t, srv, 201, "POST", "/projects/p/queues/q/messages", url.Values{"messages": {`[{"body":"a"}]`}})
+
+  // The API does not allow leases shorter than MinMessageTimeout
+  p, _ := gotcha.LoadProject("p")
+  q, _ := p.Queue("q")
+  ms, err := q.LeaseMessages(1, time.Duration(50)*time.Millisecond, nil)
+  if err != nil || len(*ms) != 1 {
+    t.Fatalf("Failed to lease message: %v", err)
+  }
+  expired := (*ms)[0]
+  time.Sleep(time.Duration(100) * time.Millisecond)
+
+  path := "/projects/p/queues/q/messages/" + expired.ID.Hex() + "/touch"
+  expect(t, srv, 409, "POST", path, url.Values{"receipt": {expired.Receipt}})
+  expect(t, srv, 409, "POST", "/projects/p/queues/q/messages/release", leased(expired))
+  again := lease(t, srv, "")
+  if len(again) != 1 || again[0].ID != expired.ID || again[0].Attempts != 2 {
+    t.Fatalf("Expired lease was not released: %+v", again)
+  }
+
+  // The receipt of the expired lease cannot be used with the new lease
+  expect(t, srv, 409, "POST", path, url.Values{"receipt": {expired.Receipt}})
+  expect(t, srv, 409, "POST", "/projects/p/queues/q/messages/release", leased(expired))
+  expect(t, srv, 409, "POST", "/projects/p/queues/q/messages/delete", leased(expired))
+  expect(t, srv, 204, "POST", "/projects/p/queues/q/messages/delete", leased(again[0]))
+}
+
+func TestMessageExpiry(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+
+  // The API does not allow expiries shorter than MinMessageExpiry
+  p, _ := gotcha.LoadProject("p")
+  q, _ := p.Queue("q")
+  now := time.Now().UTC()
+  messages := []*gotcha.Message{
+    {ID: bson.NewObjectId(), Body: []byte("short"), QueueID: q.ID, ProjectID: p.ID, CreatedAt: now, ExpiresAt: now.Add(time.Duration(50) * time.Millisecond)},
+    {ID: bson.NewObjectId(), Body: []byte("long"), QueueID: q.ID, ProjectID: p.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+  }
+  if err := gotcha.SaveMessages(&messages); err != nil {
+    t.Fatal(err)
+  }
+  time.Sleep(time.Duration(100) * time.Millisecond)
+
+  if info := queueInfo(t, srv); info.Size != 1 {
+    t.Fatalf("Expired message still counted: %+v", info)
+  }
+  ms := lease(t, srv, "count=10")
+  if len(ms) != 1 || ms[0].Body != "long" {
+    t.Fatalf("Unexpected leased messages %+v", ms)
+  }
+}
+
+func TestWaitingLeaseSeesDelayedMessages(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+
+  // The API does not allow delays shorter than a second
+  p, _ := gotcha.LoadProject("p")
+  q, _ := p.Queue("q")
+  now := time.Now().UTC()
+  visibleAt := now.Add(time.Duration(200) * time.Millisecond)
+  messages := []*gotcha.Message{
+    {ID: bson.NewObjectId(), Body: []byte("later"), QueueID: q.ID, ProjectID: p.ID, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+      VisibleAt: visibleAt, LeaseExpiresAt: visibleAt},
+  }
+  if err := gotcha.SaveMessages(&messages); err != nil {
+    t.Fatal(err)
+  }
+
+  // No consumer is woken up when the delay elapses, the waiting lease must
+  // poll the queue again
+  start := time.Now()
+  ms := lease(t, srv, "wait=10")
+  if len(ms) != 1 || ms[0].Body != "later" {
+    t.Fatalf("Unexpected leased messages %+v", ms)
+  }
+  if elapsed := time.Since(start); elapsed > time.Duration(5)*time.Second {
+    t.Fatalf("Delayed message leased after %v", elapsed)
+  }
+}
+
+func TestConcurrentLeasing(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  const total = 100
+  bodies := make([]string, total)
+  for i := range bodies {
+    bodies[i] = `{"body":"m"}`
+  }
+  expect(t, srv, 201, "POST", "/projects/p/queues/q/messages", url.Values{"messages": {"[" + strings.Join(bodies, ",") + "]"}})
+
+  var mutex sync.Mutex
+  var wg sync.WaitGroup
+  seen := make(map[bson.ObjectId]int)
+  for i := 0; i < 10; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for {
+        c, body, _ := request(t, srv, "GET", "/projects/p/queues/q/messages?count=3", nil)
+        var ms []gotcha.MessageInfo
+        if c != 200 || json.Unmarshal([]byte(body), &ms) != nil {
+          t.Errorf("Failed to lease messages: %v %v", c, body)
+          return
+        }
+        if len(ms) == 0 {
+          return
+        }
+        mutex.Lock()
+        for _, m := range ms {
+          seen[m.ID] += 1
+        }
+        mutex.Unlock()
+      }
+    }()
+  }
+  wg.Wait()
+  if len(seen) != total {
+    t.Fatalf("Leased %v distinct messages, expected %v", len(seen), total)
+  }
+  for id, n := range seen {
+    if n != 1 {
+      t.Fatalf("Message %v was leased %v times", id.Hex(), n)
+    }
+  }
+}
@@ -0,0 +1,172 @@
+package main
+
+/*
+  This file implements API authentication
+
+  Requests must carry a token in the Authorization header:
+    Authorization: Bearer <token>
+
+  The token is either the admin token given in the adminToken setting, which
+  grants access to all routes, or a project token created with
+  POST /projects/:projectName/tokens/:tokenName, which only grants access to
+  the routes of its project (/projects/:projectName and below). Requests
+  without a valid token get a 401 response, requests whose token does not
+  grant access to the route get a 403 response.
+
+  Project tokens are further limited by their scopes (see gotcha.Token):
+    - enqueue: add messages to queues and publish messages to topics
+    - consume: lease, delete, release and touch messages, stream messages
+    - admin:   all operations
+  and, if they are restricted to queues, can only be used on routes of these
+  queues. Each route declares the scopes it requires when it is registered,
+  see scoped and newRouter. Showing a queue only requires one of the enqueue
+  or consume scopes.
+
+  Alternatively requests can be signed with a project token instead of
+  carrying it, see signature.go, or made with a client certificate mapped
+  to a project, see tls.go.
+
+  Authentication is disabled when neither the adminToken setting nor the
+  tlsClientProjects setting is set. Project tokens cannot be created then and
+  the server refuses to start if any exists, so that they never silently
+  stop protecting their project.
+*/
+
+import (
+  "context"
+  "crypto/subtle"
+  "fmt"
+  "gotcha"
+  "net/http"
+  "strings"
+)
+
+// Token granting access to all routes, see adminToken setting
+var adminToken string
+
+// Key of authenticated project token in request context
+type tokenKey struct{}
+
+// "Hijack" http.Handler to add authentication
+type authenticator struct {
+  http.Handler // Anonymous field to store actual HTTP handler
+}
+
+// Authenticate request and delegate to given HTTP handler if access is granted
+func (a authenticator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  if !authEnabled() {
+    a.Handler.ServeHTTP(w, req)
+    return
+  }
+  t := certificateToken(req)
+  if t == nil && isSigned(req) {
+    var err error
+    if t, err = verifySignature(w, req); err != nil {
+      if _, ok := err.(tooLargeError); ok {
+        http.Error(w, err.Error(), 413)
+      } else if err == errTooManyNonces {
+        http.Error(w, err.Error(), 503)
+      } else {
+        w.Header().Set("WWW-Authenticate", SignatureScheme+` realm="gotcha"`)
+        http.Error(w, err.Error(), 401)
+      }
+      return
+    }
+  } else if t == nil {
+    secret := bearerToken(req)
+    if secret == "" {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="gotcha"`)
+      http.Error(w, "Authentication required", 401)
+      return
+    }
+    if adminToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(adminToken)) == 1 {
+      a.Handler.ServeHTTP(w, req)
+      return
+    }
+    var err error
+    t, err = gotcha.Authenticate(secret)
+    if err == gotcha.ErrNotFound {
+      w.Header().Set("WWW-Authenticate", `Bearer realm="gotcha", error="invalid_token"`)
+      http.Error(w, "Invalid token", 401)
+      return
+    } else if err != nil {
+      http.Error(w, fmt.Sprintf("Failed to authenticate request: %v", err), 422)
+      return
+    }
+  }
+  p, err := gotcha.Storage.LoadProjectId(t.ProjectID)
+  if err != nil {
+    http.Error(w, "Invalid token", 401)
+    return
+  }
+  if requestProject(req) != p.Name {
+    http.Error(w, fmt.Sprintf("Forbidden (token '%v' only grants access to project '%v')", t.Name, p.Name), 403)
+    return
+  }
+  // Route parameters are read from the query string where pat adds them, so
+  // drop any given by the client for scoped to see the actual ones only
+  query := req.URL.Query()
+  for k := range query {
+    if strings.HasPrefix(k, ":") {
+      delete(query, k)
+      req.URL.RawQuery = query.Encode()
+    }
+  }
+  a.Handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tokenKey{}, t)))
+}
+
+// Wrap handler so that it is only called if the project token used to
+// authenticate the request, if any, has one of the given scopes and grants
+// access to the queue given in the ":queueName" route parameter
+func scoped(h http.HandlerFunc, scopes ...string) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if t, ok := req.Context().Value(tokenKey{}).(*gotcha.Token); ok {
+      if err := t.Authorize(req.URL.Query().Get(":queueName"), scopes...); err != nil {
+        http.Error(w, fmt.Sprintf("Forbidden (%v)", err), 403)
+        return
+      }
+    }
+    h(w, req)
+  })
+}
+
+// Whether requests must be authenticated, see adminToken and
+// tlsClientProjects settings
+func authEnabled() bool {
+  return adminToken != "" || len(clientProjects) > 0
+}
+
+// Number of project tokens in all projects
+func countTokens() (int, error) {
+  ps, err := gotcha.ListProjects()
+  if err != nil {
+    return 0, err
+  }
+  count := 0
+  for _, p := range *ps {
+    ts, err := p.Tokens()
+    if err != nil {
+      return count, err
+    }
+    count += len(*ts)
+  }
+  return count, nil
+}
+
+// Token given in Authorization header, empty if there is none
+func bearerToken(req *http.Request) string {
+  auth := req.Header.Get("Authorization")
+  if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+    return ""
+  }
+  return strings.TrimSpace(auth[7:])
+}
+
+// Name of project request is addressed to, empty for routes outside projects
+func requestProject(req *http.Request) string {
+  parts := strings.SplitN(req.URL.Path, "/", 4)
+  if len(parts) < 3 || parts[0] != "" || parts[1] != "projects" {
+    return ""
+  }
+  return parts[2]
+}
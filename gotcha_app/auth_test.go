@@ -0,0 +1,24 @@
+package main
+
+import (
+  "gotcha"
+  "testing"
+)
+
+func TestTokensRequireAuthentication(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 403, "POST", "/projects/p/tokens/worker", nil)
+  if count, err := countTokens(); err != nil || count != 0 {
+    t.Fatalf("Counted %v tokens (%v), expected none", count, err)
+  }
+
+  // Tokens created while authentication was enabled prevent startup without it
+  p, _ := gotcha.LoadProject("p")
+  if _, _, err := gotcha.NewToken("worker", p, nil, nil); err != nil {
+    t.Fatal(err)
+  }
+  if count, err := countTokens(); err != nil || count != 1 {
+    t.Fatalf("Counted %v tokens (%v), expected 1", count, err)
+  }
+}
@@ -18,6 +18,13 @@ func (w loggerWriter) WriteHeader(h int) {
   w.ResponseWriter.WriteHeader(h)
 }
 
+// Delegate to original writer if it supports flushing (needed for streaming)
+func (w loggerWriter) Flush() {
+  if f, ok := w.ResponseWriter.(http.Flusher); ok {
+    f.Flush()
+  }
+}
+
 // "Hijack" http.Handler to add logging
 type httpLogger struct {
   http.Handler     // Anonymous field to store actual HTTP handler 
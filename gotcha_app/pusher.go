@@ -0,0 +1,186 @@
+package main
+
+/*
+  This file implements push queues
+
+  A queue that has subscribers is a push queue: a pusher goroutine leases its
+  messages and POSTs each of them as JSON to one of the subscribers, which
+  share the load (push is load-balanced, messages are not broadcast to all
+  subscribers). Messages are deleted when the subscriber responds with a 2xx
+  status code, otherwise they are released and retried after a delay that
+  doubles with each attempt (see Subscriber.RetryDelayAfter). Each retry goes
+  to the next subscriber so that a failing subscriber does not hold messages
+  forever, the delay counts all attempts whichever subscribers they went to.
+  Queues that set maxAttempts move messages that could not be delivered to
+  their dead-letter queue as usual.
+
+  There is one pusher per push queue, started when the first subscriber is
+  added (or on startup) and stopped once the queue has no subscriber left.
+*/
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "gotcha"
+  "labix.org/v2/mgo/bson"
+  "log"
+  "net/http"
+  "sort"
+  "sync"
+  "time"
+)
+
+// Maximum number of messages delivered concurrently by each pusher
+const PushBatchSize = 10
+
+// Maximum time pushers wait for new messages before checking for messages
+// whose retry delay elapsed
+const PushPollInterval = time.Duration(1) * time.Second
+
+// Ids of queues that have a running pusher
+var pushers = make(map[bson.ObjectId]bool)
+
+// Protects pushers
+var pushersMutex sync.Mutex
+
+// Start pushers for all queues that have subscribers
+func startPushers() error {
+  ps, err := gotcha.ListProjects()
+  if err != nil {
+    return err
+  }
+  for _, p := range *ps {
+    qs, err := p.Queues()
+    if err != nil {
+      return err
+    }
+    for i := range *qs {
+      q := &(*qs)[i]
+      if subs, err := q.Subscribers(); err != nil {
+        return err
+      } else if len(*subs) > 0 {
+        startPusher(q)
+      }
+    }
+  }
+  return nil
+}
+
+// Start pusher for given queue unless one is already running
+func startPusher(q *gotcha.Queue) {
+  pushersMutex.Lock()
+  defer pushersMutex.Unlock()
+  if pushers[q.ID] {
+    return
+  }
+  pushers[q.ID] = true
+  go push(q.ID)
+}
+
+// Deliver messages of queue with given id to its subscribers until the queue
+// is deleted or has no subscriber left
+func push(queueID bson.ObjectId) {
+  for {
+    q, subs, err := pushTargets(queueID)
+    if err != nil {
+      log.Printf("**ERROR: Failed to load subscribers of queue %v: %v", queueID.Hex(), err)
+      time.Sleep(PushPollInterval)
+      continue
+    }
+    if q == nil {
+      return
+    }
+    timeout := gotcha.MinSubscriberTimeout
+    for _, s := range subs {
+      if s.Timeout > timeout {
+        timeout = s.Timeout
+      }
+    }
+    // Leases must outlast delivery requests so messages aren't leased twice
+    messages, err := q.WaitMessages(PushBatchSize, timeout + MinMessageTimeout, PushPollInterval, nil, nil)
+    if err != nil {
+      log.Printf("**ERROR: Failed to lease messages from push queue %v: %v", q.Name, err)
+      time.Sleep(PushPollInterval)
+      continue
+    }
+    var wg sync.WaitGroup
+    for _, m := range *messages {
+      wg.Add(1)
+      go func(m gotcha.MessageInfo) {
+        defer wg.Done()
+        deliver(q, &subs[(m.Attempts - 1) % len(subs)], &m)
+      }(m)
+    }
+    wg.Wait()
+  }
+}
+
+// Load queue with given id and its subscribers sorted by name
+// Return nil queue and unregister pusher if queue was deleted or has no
+// subscriber, this is done atomically with startPusher
+func pushTargets(queueID bson.ObjectId) (*gotcha.Queue, []gotcha.Subscriber, error) {
+  pushersMutex.Lock()
+  defer pushersMutex.Unlock()
+  q, err := gotcha.Storage.LoadQueueId(queueID)
+  if err == gotcha.ErrNotFound {
+    delete(pushers, queueID)
+    return nil, nil, nil
+  } else if err != nil {
+    return nil, nil, err
+  }
+  subs, err := q.Subscribers()
+  if err != nil {
+    return nil, nil, err
+  }
+  if len(*subs) == 0 {
+    delete(pushers, queueID)
+    return nil, nil, nil
+  }
+  sort.Sort(subscribersByName(*subs))
+  return q, *subs, nil
+}
+
+// POST message to subscriber, delete it on success and release it with the
+// subscriber retry delay otherwise
+func deliver(q *gotcha.Queue, s *gotcha.Subscriber, m *gotcha.MessageInfo) {
+  ids, receipts := []string{m.ID.Hex()}, []string{m.Receipt}
+  err := post(s, m)
+  if err == nil {
+    err = q.DeleteMessages(&ids, &receipts)
+  } else {
+    delay := s.RetryDelayAfter(m.Attempts)
+    log.Printf("Failed to push message %v to subscriber %v (attempt %v), retrying in %v: %v", m.ID.Hex(), s.Name, m.Attempts, delay, err)
+    err = q.ReleaseMessages(&ids, &receipts, delay)
+  }
+  if err != nil {
+    log.Printf("**ERROR: Failed to complete delivery of message %v to subscriber %v: %v", m.ID.Hex(), s.Name, err)
+  }
+}
+
+// Send message to subscriber, return an error if the response status code is
+// not 2xx
+func post(s *gotcha.Subscriber, m *gotcha.MessageInfo) error {
+  b, err := json.Marshal(m)
+  if err != nil {
+    return err
+  }
+  client := http.Client{Timeout: s.Timeout}
+  res, err := client.Post(s.URL, "application/json", bytes.NewReader(b))
+  if err != nil {
+    return err
+  }
+  res.Body.Close()
+  if res.StatusCode < 200 || res.StatusCode > 299 {
+    return errors.New(fmt.Sprintf("subscriber responded with status %v", res.StatusCode))
+  }
+  return nil
+}
+
+// Sort subscribers by name so that retries go to each subscriber in turn
+type subscribersByName []gotcha.Subscriber
+
+func (s subscribersByName) Len() int           { return len(s) }
+func (s subscribersByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s subscribersByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
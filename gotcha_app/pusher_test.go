@@ -0,0 +1,128 @@
+package main
+
+import (
+  "encoding/json"
+  "gotcha"
+  "io/ioutil"
+  "labix.org/v2/mgo/bson"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+// Create queue "q" in project "p" of a new in-memory store with one message,
+// return the queue and the id of the message
+func newPushQueue(t *testing.T) (*gotcha.Queue, bson.ObjectId) {
+  gotcha.Storage = gotcha.NewMemoryStore()
+  p, err := gotcha.NewProject("p")
+  if err != nil {
+    t.Fatal(err)
+  }
+  q, err := gotcha.NewQueue("q", p, gotcha.QueueSettings{})
+  if err != nil {
+    t.Fatal(err)
+  }
+  now := time.Now().UTC()
+  messages := []*gotcha.Message{{ID: bson.NewObjectId(), Body: []byte("a"), QueueID: q.ID, ProjectID: p.ID,
+    CreatedAt: now, ExpiresAt: now.Add(time.Hour)}}
+  if err := gotcha.SaveMessages(&messages); err != nil {
+    t.Fatal(err)
+  }
+  return q, messages[0].ID
+}
+
+// Lease the message of queue and deliver it to subscriber
+func leaseAndDeliver(t *testing.T, q *gotcha.Queue, s *gotcha.Subscriber) *gotcha.MessageInfo {
+  ms, err := q.LeaseMessages(1, time.Minute, nil)
+  if err != nil || len(*ms) != 1 {
+    t.Fatalf("Failed to lease message (%v)", err)
+  }
+  m := &(*ms)[0]
+  deliver(q, s, m)
+  return m
+}
+
+// Fail test unless message was released and becomes visible 'delay' from now
+func expectReleased(t *testing.T, id bson.ObjectId, attempts int, delay time.Duration) {
+  t.Helper()
+  m, err := gotcha.LoadMessage(id.Hex())
+  if err != nil {
+    t.Fatalf("Failed to load released message: %v", err)
+  }
+  if m.Attempts != attempts || m.Receipt != "" {
+    t.Fatalf("Message was not released after attempt %v: %+v", attempts, m)
+  }
+  if expected := time.Now().Add(delay); m.VisibleAt.Before(expected.Add(-time.Duration(50) * time.Millisecond)) || m.VisibleAt.After(expected) {
+    t.Fatalf("Message is visible at %v, expected %v", m.VisibleAt, expected)
+  }
+}
+
+func TestDeliverDeletesMessageOn2xx(t *testing.T) {
+  q, id := newPushQueue(t)
+  var received gotcha.MessageInfo
+  target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    b, _ := ioutil.ReadAll(req.Body)
+    json.Unmarshal(b, &received)
+    w.WriteHeader(202)
+  }))
+  defer target.Close()
+  s := &gotcha.Subscriber{Name: "s", SubscriberSettings: gotcha.SubscriberSettings{URL: target.URL,
+    Timeout: time.Second, RetryDelay: time.Minute, MaxRetryDelay: time.Hour}}
+
+  leaseAndDeliver(t, q, s)
+  if received.ID != id || received.Body != "a" {
+    t.Fatalf("Subscriber received %+v", received)
+  }
+  if _, err := gotcha.LoadMessage(id.Hex()); err != gotcha.ErrNotFound {
+    t.Fatalf("Delivered message was not deleted (%v)", err)
+  }
+}
+
+func TestDeliverReleasesMessageWithBackoffOnError(t *testing.T) {
+  q, id := newPushQueue(t)
+  target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    w.WriteHeader(500)
+  }))
+  defer target.Close()
+  s := &gotcha.Subscriber{Name: "s", SubscriberSettings: gotcha.SubscriberSettings{URL: target.URL,
+    Timeout: time.Second, RetryDelay: time.Duration(100) * time.Millisecond, MaxRetryDelay: time.Second}}
+
+  leaseAndDeliver(t, q, s)
+  expectReleased(t, id, 1, s.RetryDelayAfter(1))
+  if ms, _ := q.LeaseMessages(1, time.Minute, nil); len(*ms) != 0 {
+    t.Fatal("Released message was leased before its retry delay elapsed")
+  }
+  time.Sleep(s.RetryDelayAfter(1))
+
+  m := leaseAndDeliver(t, q, s)
+  if m.Attempts != 2 {
+    t.Fatalf("Retried message was leased with %v attempts, expected 2", m.Attempts)
+  }
+  expectReleased(t, id, 2, s.RetryDelayAfter(2))
+  if s.RetryDelayAfter(2) != 2*s.RetryDelay {
+    t.Fatalf("Retry delay did not double: %v", s.RetryDelayAfter(2))
+  }
+}
+
+func TestDeliverReleasesMessageOnTimeout(t *testing.T) {
+  q, id := newPushQueue(t)
+  target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    // The request context is only canceled on disconnection once the body is read
+    ioutil.ReadAll(req.Body)
+    select {
+    case <-req.Context().Done():
+    case <-time.After(time.Duration(5) * time.Second):
+    }
+  }))
+  defer target.Close()
+  s := &gotcha.Subscriber{Name: "s", SubscriberSettings: gotcha.SubscriberSettings{URL: target.URL,
+    Timeout: time.Duration(100) * time.Millisecond, RetryDelay: time.Minute, MaxRetryDelay: time.Hour}}
+
+  start := time.Now()
+  leaseAndDeliver(t, q, s)
+  if elapsed := time.Since(start); elapsed > time.Second {
+    t.Fatalf("Delivery took %v despite %v timeout", elapsed, s.Timeout)
+  }
+  expectReleased(t, id, 1, s.RetryDelayAfter(1))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+  "gotcha"
+  "log"
+  "time"
+)
+
+// Periodically delete expired messages from all queues in the background
+// At most 'batchSize' messages are deleted from each queue at each run
+func startReaper(interval time.Duration, batchSize int) {
+  go func() {
+    for _ = range time.Tick(interval) {
+      start := time.Now()
+      count, err := gotcha.PurgeExpiredMessages(batchSize)
+      if err != nil {
+        log.Printf("**ERROR: Failed to purge expired messages: %v", err)
+      }
+      if count > 0 {
+        ms := time.Now().Sub(start).Nanoseconds() / 1000000
+        log.Printf("Purged %v expired messages in %vms", count, ms)
+      }
+    }
+  }()
+}
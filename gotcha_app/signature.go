@@ -0,0 +1,168 @@
+package main
+
+/*
+  This file implements HMAC signed requests
+
+  Instead of sending their token, clients may sign requests with the token
+  signing secret so that no secret goes through (possibly untrusted) proxies:
+    Authorization: HMAC-SHA256 token=<name>, timestamp=<ts>, nonce=<nonce>, signature=<sig>
+
+  where:
+    - name is the name of a token of the project the request is addressed to
+    - ts is the current time in seconds since epoch
+    - nonce is a random string (8 to 64 characters) never reused with the token
+    - sig is the hex encoded HMAC-SHA256 of the string
+        <METHOD>\n<path>\n<content type>\n<ts>\n<nonce>\n<body hash>
+      with path the request path including the query string if any (as sent),
+      content type the Content-Type header (empty if there is none), body hash
+      the hex encoded SHA-256 of the request body (of the empty string if
+      there is none) and the token signing secret as key
+
+  Signing secrets are returned when tokens are created, only tokens created
+  while the signingSecretsKey setting is set have one. They are stored
+  encrypted with that key (see gotcha.Token) so that a copy of the database
+  is not enough to sign requests. Signed requests naming a token without
+  signing secret are rejected.
+
+  Requests whose timestamp is more than signatureWindow seconds away from the
+  server time are rejected, so are requests reusing a nonce seen within the
+  window. Nonces are kept in memory so instances do not share them.
+*/
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "gotcha"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Authorization scheme of signed requests
+const SignatureScheme = "HMAC-SHA256"
+
+// Maximum number of nonces remembered at once, signed requests are rejected
+// when that many were received within the signature window
+const MaxNonces = 100000
+
+// Maximum difference between signed requests timestamps and server time, see
+// signatureWindow setting
+var signatureWindow = time.Duration(5) * time.Minute
+
+// Nonces of signed requests received within the signature window, indexed by
+// token id and nonce, with the time they can be forgotten
+var nonces = make(map[string]time.Time)
+
+// Protects nonces
+var noncesMutex sync.Mutex
+
+// Error returned when MaxNonces nonces are already remembered
+var errTooManyNonces = errors.New("Too many signed requests, retry later")
+
+// Whether request is signed (as opposed to carrying a bearer token)
+func isSigned(req *http.Request) bool {
+  auth := req.Header.Get("Authorization")
+  return len(auth) > len(SignatureScheme) && strings.EqualFold(auth[:len(SignatureScheme)+1], SignatureScheme+" ")
+}
+
+// Verify signature of signed request, return the token it was signed with
+// Return a tooLargeError if the body is too large to be hashed and
+// errTooManyNonces if the nonce cannot be remembered, errors are suitable
+// for 401 responses otherwise
+// The request body is read and replaced so that handlers can read it again
+func verifySignature(w http.ResponseWriter, req *http.Request) (*gotcha.Token, error) {
+  params := make(map[string]string)
+  for _, p := range strings.Split(req.Header.Get("Authorization")[len(SignatureScheme)+1:], ",") {
+    kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+    if len(kv) == 2 {
+      params[kv[0]] = kv[1]
+    }
+  }
+  for _, k := range []string{"token", "timestamp", "nonce", "signature"} {
+    if params[k] == "" {
+      return nil, errors.New(fmt.Sprintf("Invalid signature ('%v' is missing)", k))
+    }
+  }
+  ts, err := strconv.ParseInt(params["timestamp"], 10, 64)
+  if err != nil {
+    return nil, errors.New("Invalid signature (timestamp must be a number of seconds since epoch)")
+  }
+  now, signedAt := time.Now(), time.Unix(ts, 0)
+  if d := now.Sub(signedAt); d > signatureWindow || d < -signatureWindow {
+    return nil, errors.New(fmt.Sprintf("Invalid signature (timestamp must be within %v of server time)", signatureWindow))
+  }
+  nonce := params["nonce"]
+  if len(nonce) < 8 || len(nonce) > 64 {
+    return nil, errors.New("Invalid signature (nonce must be 8 to 64 characters long)")
+  }
+  p, err := gotcha.LoadProject(requestProject(req))
+  if err != nil {
+    return nil, errors.New("Invalid signature (unknown token)")
+  }
+  t, err := p.Token(params["token"])
+  if err != nil {
+    return nil, errors.New("Invalid signature (unknown token)")
+  }
+  if t.SigningSecret == "" {
+    return nil, errors.New(fmt.Sprintf("Invalid signature (token '%v' was created without a signing secret and cannot sign requests)", t.Name))
+  }
+  key, err := t.DecryptSigningSecret()
+  if err != nil {
+    return nil, errors.New("Invalid signature (token signing secret cannot be decrypted with the signingSecretsKey setting)")
+  }
+  body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, int64(maxRequestSize)))
+  if err != nil {
+    if _, ok := err.(*http.MaxBytesError); ok {
+      return nil, tooLargeError(fmt.Sprintf("Request is too large (%v bytes max)", maxRequestSize))
+    }
+    return nil, errors.New("Invalid signature (could not read body)")
+  }
+  req.Body = ioutil.NopCloser(bytes.NewReader(body))
+  bodyHash := sha256.Sum256(body)
+  path := req.URL.EscapedPath()
+  if req.URL.RawQuery != "" {
+    path += "?" + req.URL.RawQuery
+  }
+  mac := hmac.New(sha256.New, []byte(key))
+  fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n%v\n%v", req.Method, path, req.Header.Get("Content-Type"), params["timestamp"], nonce,
+    hex.EncodeToString(bodyHash[:]))
+  signature, err := hex.DecodeString(params["signature"])
+  if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+    return nil, errors.New("Invalid signature")
+  }
+  if err := useNonce(t, nonce, now, signedAt.Add(signatureWindow)); err != nil {
+    return nil, err
+  }
+  return t, nil
+}
+
+// Record nonce of signed request until 'until', after which the request
+// timestamp is out of the signature window anyway
+// Return an error if the nonce was already used with token
+func useNonce(t *gotcha.Token, nonce string, now, until time.Time) error {
+  noncesMutex.Lock()
+  defer noncesMutex.Unlock()
+  key := t.ID.Hex() + ":" + nonce
+  if expiresAt, ok := nonces[key]; ok && expiresAt.After(now) {
+    return errors.New("Invalid signature (nonce was already used)")
+  }
+  if len(nonces) >= MaxNonces {
+    for k, expiresAt := range nonces {
+      if !expiresAt.After(now) {
+        delete(nonces, k)
+      }
+    }
+    if len(nonces) >= MaxNonces {
+      return errTooManyNonces
+    }
+  }
+  nonces[key] = until
+  return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "gotcha"
+  "labix.org/v2/mgo/bson"
+  "net/http"
+  "strconv"
+  "testing"
+  "time"
+)
+
+// Send request signed with given key for given token of project "p"
+// 'signedType' is the content type included in the signature, it may differ
+// from the one sent
+func signedRequest(t *testing.T, url, path, body, contentType, signedType, token, key string) int {
+  ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), bson.NewObjectId().Hex()
+  bodyHash := sha256.Sum256([]byte(body))
+  mac := hmac.New(sha256.New, []byte(key))
+  fmt.Fprintf(mac, "POST\n%v\n%v\n%v\n%v\n%v", path, signedType, ts, nonce, hex.EncodeToString(bodyHash[:]))
+  req, err := http.NewRequest("POST", url+path, bytes.NewReader([]byte(body)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  req.Header.Set("Content-Type", contentType)
+  req.Header.Set("Authorization", fmt.Sprintf("%v token=%v, timestamp=%v, nonce=%v, signature=%x", SignatureScheme, token, ts, nonce, mac.Sum(nil)))
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  res.Body.Close()
+  return res.StatusCode
+}
+
+func TestSignedRequests(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  adminToken = "admin"
+  previousKey := gotcha.SigningSecretsKey()
+  t.Cleanup(func() {
+    adminToken = ""
+    gotcha.SetSigningSecretsKey(previousKey)
+  })
+  p, _ := gotcha.LoadProject("p")
+
+  // Tokens created without signingSecretsKey setting cannot sign requests
+  gotcha.SetSigningSecretsKey(nil)
+  plain, plainSecret, err := gotcha.NewToken("plain", p, nil, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if plain.SigningSecret != "" {
+    t.Fatal("Token was created with signing secret")
+  }
+
+  if err := gotcha.SetSigningSecretsKey(bytes.Repeat([]byte{7}, 32)); err != nil {
+    t.Fatal(err)
+  }
+  token, secret, err := gotcha.NewToken("worker", p, nil, nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if token.SigningSecret == "" {
+    t.Fatal("Token was created without signing secret")
+  }
+  key, err := token.DecryptSigningSecret()
+  if err != nil || key == "" || key == secret || bytes.Contains([]byte(token.SigningSecret), []byte(key)) {
+    t.Fatalf("Signing secret %q is not stored encrypted (%v)", key, err)
+  }
+
+  path, body, form := "/projects/p/queues/q/messages", "messages=%5B%7B%22body%22%3A%22a%22%7D%5D", "application/x-www-form-urlencoded"
+  if c := signedRequest(t, srv.URL, path, body, form, form, "worker", key); c != 201 {
+    t.Fatalf("Signed request got %v", c)
+  }
+  if c := signedRequest(t, srv.URL, path, body, "text/plain", form, "worker", key); c != 401 {
+    t.Fatalf("Request with altered content type got %v", c)
+  }
+  if c := signedRequest(t, srv.URL, path, body, form, form, "worker", token.Hash); c != 401 {
+    t.Fatalf("Request signed with stored token hash got %v", c)
+  }
+  if c := signedRequest(t, srv.URL, path, body, form, form, "worker", secret); c != 401 {
+    t.Fatalf("Request signed with token secret got %v", c)
+  }
+  if c := signedRequest(t, srv.URL, path, body, form, form, "plain", plainSecret); c != 401 {
+    t.Fatalf("Request signed by token without signing secret got %v", c)
+  }
+}
@@ -0,0 +1,320 @@
+package main
+
+/*
+  This file implements the streaming consumer endpoint
+
+  Messages are leased continuously on behalf of connected clients and pushed
+  to them as Server-Sent Events. Clients acknowledge processed messages through
+  a separate endpoint which deletes them, messages still in flight when the
+  connection drops are released back to the queue.
+*/
+
+import (
+  "encoding/json"
+  "fmt"
+  "gotcha"
+  "io"
+  "log"
+  "net/http"
+  "sync"
+  "time"
+)
+
+// Default maximum number of unacknowledged messages per stream
+const DefaultStreamInFlight = 10
+
+// Interval at which keep-alive comments are sent to idle streams
+const StreamKeepAlive = time.Duration(15) * time.Second
+
+// A connected streaming consumer
+type stream struct {
+  queue    *gotcha.Queue       // Queue messages are leased from
+  inFlight map[string]inFlight // Unacknowledged messages indexed by id
+  acked    chan bool           // Signaled when messages are acknowledged
+  mutex    sync.Mutex          // Protects inFlight
+}
+
+// Message pushed to stream client and not acknowledged yet
+type inFlight struct {
+  receipt        string    // Receipt of lease
+  leaseExpiresAt time.Time // Lease expiry, message is no longer in flight after that
+}
+
+// Connected streams indexed by id
+var streams = make(map[string]*stream)
+
+// Protects streams
+var streamsMutex sync.Mutex
+
+/*
+ GET /projects/:projectName/queues/:queueName/stream?maxInFlight=10&timeout=30
+
+ Stream messages from queue as Server-Sent Events
+
+ Messages are leased and sent as soon as they are available as long as fewer
+ than 'maxInFlight' sent messages are unacknowledged. Messages must be
+ acknowledged with POST .../stream/:streamId/ack (see below) which deletes
+ them. Messages that are not acknowledged before their lease expires are
+ put back in the queue, unacknowledged messages are also put back in the
+ queue when the connection is closed.
+
+ Events:
+   - stream:  First event, data is a JSON encoded hash with the stream id
+              {id:"4f3ea2c0"}
+   - message: Leased message, data is a JSON encoded hash with the same
+              content as messages returned by GET .../messages
+   - error:   Leasing failed and stream is closed, data is the error message
+
+ Comments are sent every 15 seconds when there is no message to keep the
+ connection alive.
+
+ Parameters
+ - maxInFlight: optional, Maximum number of unacknowledged messages (100 max),
+                default to 10
+ - timeout: optional, Lease timeout in seconds, default to 60
+
+ Response
+   - code: 200
+   - header: Content-Type: text/event-stream
+   - body: events
+
+ Not found error
+   - code: 404
+   - body: Queue not found
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+*/
+func streamMessages(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  maxInFlight, err := extractInt(req.URL.Query().Get("maxInFlight"), 1, MaxLeaseCount, DefaultStreamInFlight)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (maxInFlight)", err), 400)
+    return
+  }
+  timeout, err := extractDuration(req.URL.Query().Get("timeout"), MinMessageTimeout, MaxMessageTimeout, DefaultMessageTimeout)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Badly formed request: %v (timeout)", err), 400)
+    return
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "Streaming not supported", 500)
+    return
+  }
+  id := gotcha.NewRandomID()
+  s := &stream{queue: q, inFlight: make(map[string]inFlight), acked: make(chan bool, 1)}
+  streamsMutex.Lock()
+  streams[id] = s
+  streamsMutex.Unlock()
+  defer func() {
+    streamsMutex.Lock()
+    delete(streams, id)
+    streamsMutex.Unlock()
+    s.releaseAll()
+  }()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  b, _ := json.Marshal(map[string]string{"id": id})
+  if err := writeEvent(w, flusher, "", "stream", string(b)); err != nil {
+    return
+  }
+  done := req.Context().Done()
+  for {
+    select {
+    case <-done:
+      return
+    default:
+    }
+    count := maxInFlight - s.pending()
+    if count <= 0 {
+      select {
+      case <-done:
+        return
+      case <-s.acked:
+        continue
+      case <-time.After(StreamKeepAlive):
+      }
+      if err := writeKeepAlive(w, flusher); err != nil {
+        return
+      }
+      continue
+    }
+    messages, err := q.WaitMessages(count, timeout, StreamKeepAlive, nil, done)
+    if err != nil {
+      log.Printf("**ERROR: Failed to lease messages for stream %v: %v", id, err)
+      writeEvent(w, flusher, "", "error", fmt.Sprintf("Failed to lease messages (%v)", err))
+      return
+    }
+    if len(*messages) == 0 {
+      if err := writeKeepAlive(w, flusher); err != nil {
+        return
+      }
+      continue
+    }
+    for _, m := range *messages {
+      s.add(&m)
+      b, err := json.Marshal(m)
+      if err == nil {
+        err = writeEvent(w, flusher, m.ID.Hex(), "message", string(b))
+      }
+      if err != nil {
+        return
+      }
+    }
+  }
+}
+
+/*
+ POST /projects/:projectName/queues/:queueName/stream/:streamId/ack
+
+ Acknowledge messages received through stream, acknowledged messages are
+ deleted from the queue
+
+ ids should be be in a JSON encoded array in the "messageIds" form value,
+ receipts are not needed as they are known to the stream
+
+ Parameters (Form-Encoded array containing JSON data)
+ - messageIds: required, Ids of messages to be acknowledged
+
+ Response
+   - code: 204
+   - header: none
+
+ Not found error
+   - code: 404
+   - body: Queue not found or Stream not found or Message not found
+
+ Lease expired or invalid receipt error (message was leased again since)
+   - code: 409
+   - body: <Error message>
+
+ Badly formed request error
+   - code: 400
+   - body: <Error message>
+
+ Misc error (e.g. lost connection to MongoDB)
+   - code: 422
+   - body: <Error message>
+*/
+func ackMessages(w http.ResponseWriter, req *http.Request) {
+  q, err := findQueue(w, req)
+  if err != nil {
+    http.Error(w, "Queue not found", 404)
+    return
+  }
+  streamsMutex.Lock()
+  s, ok := streams[req.URL.Query().Get(":streamId")]
+  streamsMutex.Unlock()
+  if !ok || s.queue.ID != q.ID {
+    http.Error(w, "Stream not found", 404)
+    return
+  }
+  messageIds := make([]string, 0)
+  if err := json.Unmarshal([]byte(req.FormValue("messageIds")), &messageIds); err != nil {
+    http.Error(w, "Badly formed request ('messageIds' value is missing or contains malformed JSON)", 400)
+    return
+  }
+  err = s.ack(&messageIds)
+  if err == gotcha.ErrNotFound {
+    http.Error(w, "Message not found", 404)
+    return
+  } else if err == gotcha.ErrLeaseExpired || err == gotcha.ErrInvalidReceipt {
+    http.Error(w, "Could not acknowledge all messages: message lease has expired", 409)
+    return
+  } else if err != nil {
+    http.Error(w, fmt.Sprintf("Could not acknowledge all messages: %v", err), 422)
+    return
+  }
+  w.WriteHeader(204)
+}
+
+// Record message sent to client
+func (s *stream) add(m *gotcha.MessageInfo) {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  s.inFlight[m.ID.Hex()] = inFlight{receipt: m.Receipt, leaseExpiresAt: m.LeaseExpiresAt}
+}
+
+// Number of messages sent to client whose lease hasn't expired
+// Messages whose lease expired are forgotten as they went back to the queue
+func (s *stream) pending() int {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  now := time.Now()
+  for id, m := range s.inFlight {
+    if m.leaseExpiresAt.Before(now) {
+      delete(s.inFlight, id)
+    }
+  }
+  return len(s.inFlight)
+}
+
+// Delete acknowledged messages and wake up stream
+// Messages that are not in flight are reported as having an expired lease
+func (s *stream) ack(messageIds *[]string) error {
+  defer func() {
+    select {
+    case s.acked <- true:
+    default:
+    }
+  }()
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for _, id := range *messageIds {
+    m, ok := s.inFlight[id]
+    if !ok {
+      return gotcha.ErrLeaseExpired
+    }
+    err := s.queue.DeleteMessages(&[]string{id}, &[]string{m.receipt})
+    if err == nil || err == gotcha.ErrLeaseExpired || err == gotcha.ErrInvalidReceipt {
+      delete(s.inFlight, id)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Put all messages in flight back in queue, called when client disconnects
+func (s *stream) releaseAll() {
+  s.mutex.Lock()
+  defer s.mutex.Unlock()
+  for id, m := range s.inFlight {
+    err := s.queue.ReleaseMessages(&[]string{id}, &[]string{m.receipt}, time.Duration(0))
+    if err != nil && err != gotcha.ErrLeaseExpired && err != gotcha.ErrInvalidReceipt && err != gotcha.ErrNotFound {
+      log.Printf("**ERROR: Failed to release message %v: %v", id, err)
+    }
+  }
+  s.inFlight = make(map[string]inFlight)
+}
+
+// Send Server-Sent Event to client
+func writeEvent(w io.Writer, f http.Flusher, id, event, data string) error {
+  if id != "" {
+    if _, err := fmt.Fprintf(w, "id: %v\n", id); err != nil {
+      return err
+    }
+  }
+  if _, err := fmt.Fprintf(w, "event: %v\ndata: %v\n\n", event, data); err != nil {
+    return err
+  }
+  f.Flush()
+  return nil
+}
+
+// Send comment to client so the connection isn't considered idle
+func writeKeepAlive(w io.Writer, f http.Flusher) error {
+  if _, err := io.WriteString(w, ":\n\n"); err != nil {
+    return err
+  }
+  f.Flush()
+  return nil
+}
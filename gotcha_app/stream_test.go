@@ -0,0 +1,47 @@
+package main
+
+import (
+  "bufio"
+  "context"
+  "net/http"
+  "net/url"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestStreamReleasesMessagesOnDisconnect(t *testing.T) {
+  srv := newTestServer(t)
+  expect(t, srv, 204, "POST", "/projects/p", nil)
+  expect(t, srv, 204, "POST", "/projects/p/queues/q", nil)
+  expect(t, srv, 201, "POST", "/projects/p/queues/q/messages", url.Values{"messages": {`[{"body":"a"}]`}})
+
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/projects/p/queues/q/stream?maxInFlight=5", nil)
+  if err != nil {
+    t.Fatal(err)
+  }
+  res, err := http.DefaultClient.Do(req)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer res.Body.Close()
+  lines := bufio.NewScanner(res.Body)
+  for lines.Scan() && !strings.HasPrefix(lines.Text(), "event: message") {
+  }
+  if info := queueInfo(t, srv); info.InFlight != 1 {
+    t.Fatalf("Streamed message is not in flight: %+v", info)
+  }
+
+  // The stream waits for more messages, disconnecting must release the
+  // streamed one right away rather than after the keep-alive interval
+  cancel()
+  deadline := time.Now().Add(time.Duration(2) * time.Second)
+  for queueInfo(t, srv).Ready != 1 {
+    if time.Now().After(deadline) {
+      t.Fatal("Streamed message was not released when client disconnected")
+    }
+    time.Sleep(time.Duration(10) * time.Millisecond)
+  }
+}
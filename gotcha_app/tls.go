@@ -0,0 +1,156 @@
+package main
+
+/*
+  This file implements TLS and mutual TLS serving
+
+  TLS is enabled by setting tlsCertFile and tlsKeyFile to the PEM encoded
+  server certificate (chain) and private key. Setting tlsClientCAFile to PEM
+  encoded CA certificates makes the server verify client certificates issued
+  by these CAs. Clients without a certificate are still accepted (and must
+  authenticate with a token) unless tlsRequireClientCert is "true".
+
+  Verified client certificates authenticate requests when the common name of
+  their subject is mapped to a project in the tlsClientProjects setting:
+    tlsClientProjects: "worker-1=orders, billing=invoices"
+  Such requests get access to the routes of the project as with a token that
+  has the admin scope (see auth.go).
+
+  Certificate, key and client CA files are reloaded when the process receives
+  SIGHUP. Established connections are kept, new handshakes use the new files.
+  The previous files keep being used if the new ones cannot be loaded.
+*/
+
+import (
+  "crypto/tls"
+  "crypto/x509"
+  "errors"
+  "fmt"
+  "gotcha"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "strings"
+  "sync/atomic"
+  "syscall"
+)
+
+// Client certificate subject common names mapped to project names, see
+// tlsClientProjects setting
+var clientProjects = make(map[string]string)
+
+// Files TLS configuration is loaded from and the configuration built from
+// their current content
+type tlsFiles struct {
+  certFile          string       // Path to PEM encoded server certificate
+  keyFile           string       // Path to PEM encoded server private key
+  clientCAFile      string       // Path to PEM encoded client CA certificates, empty if client certificates are not verified
+  requireClientCert bool         // Whether clients must present a valid certificate
+  current           atomic.Value // *tls.Config used by new handshakes, replaced as a whole on reload
+}
+
+// Create TLS configuration from settings, return nil if TLS is disabled
+// Files are reloaded on SIGHUP for as long as the process runs
+func newTLSConfig(settings map[string]string) (*tls.Config, error) {
+  if settings["tlsCertFile"] == "" && settings["tlsKeyFile"] == "" {
+    if settings["tlsClientCAFile"] != "" {
+      return nil, errors.New("tlsClientCAFile requires tlsCertFile and tlsKeyFile")
+    }
+    return nil, nil
+  }
+  files := &tlsFiles{certFile: settings["tlsCertFile"], keyFile: settings["tlsKeyFile"],
+    clientCAFile: settings["tlsClientCAFile"], requireClientCert: settings["tlsRequireClientCert"] == "true"}
+  if files.requireClientCert && files.clientCAFile == "" {
+    return nil, errors.New("tlsRequireClientCert requires tlsClientCAFile")
+  }
+  if err := files.load(); err != nil {
+    return nil, err
+  }
+  go files.reloadOnHangup()
+  return &tls.Config{GetConfigForClient: files.config}, nil
+}
+
+// Parse tlsClientProjects setting ("<common name>=<project>, ...")
+func parseClientProjects(setting string) (map[string]string, error) {
+  projects := make(map[string]string)
+  for _, entry := range strings.Split(setting, ",") {
+    if strings.TrimSpace(entry) == "" {
+      continue
+    }
+    kv := strings.SplitN(entry, "=", 2)
+    if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+      return nil, errors.New(fmt.Sprintf("invalid entry '%v' (must be <common name>=<project>)", strings.TrimSpace(entry)))
+    }
+    projects[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+  }
+  return projects, nil
+}
+
+// Load certificate, key and client CA files and replace the configuration
+// built from them, keep current configuration on error
+func (f *tlsFiles) load() error {
+  cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+  if err != nil {
+    return errors.New(fmt.Sprintf("Could not load TLS certificate '%v' and key '%v': %v", f.certFile, f.keyFile, err))
+  }
+  var clientCAs *x509.CertPool
+  if f.clientCAFile != "" {
+    pem, err := ioutil.ReadFile(f.clientCAFile)
+    if err != nil {
+      return errors.New(fmt.Sprintf("Could not load TLS client CA file '%v': %v", f.clientCAFile, err))
+    }
+    clientCAs = x509.NewCertPool()
+    if !clientCAs.AppendCertsFromPEM(pem) {
+      return errors.New(fmt.Sprintf("No PEM encoded certificate found in TLS client CA file '%v'", f.clientCAFile))
+    }
+  }
+  config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12,
+    NextProtos: []string{"h2", "http/1.1"}}
+  if clientCAs != nil {
+    config.ClientCAs, config.ClientAuth = clientCAs, tls.VerifyClientCertIfGiven
+    if f.requireClientCert {
+      config.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+  }
+  f.current.Store(config)
+  return nil
+}
+
+// Reload files whenever the process receives SIGHUP
+func (f *tlsFiles) reloadOnHangup() {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+  for range hup {
+    if err := f.load(); err != nil {
+      log.Printf("**ERROR: Failed to reload TLS files, still using previous ones: %v", err)
+    } else {
+      log.Printf("Reloaded TLS files")
+    }
+  }
+}
+
+// TLS configuration for new handshakes
+// The same configuration is shared by all handshakes until files are reloaded
+func (f *tlsFiles) config(*tls.ClientHelloInfo) (*tls.Config, error) {
+  return f.current.Load().(*tls.Config), nil
+}
+
+// Token standing for the verified client certificate of request if its
+// subject is mapped to an existing project, nil otherwise
+// The token has the admin scope and is never stored
+func certificateToken(req *http.Request) *gotcha.Token {
+  if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+    return nil
+  }
+  cn := req.TLS.VerifiedChains[0][0].Subject.CommonName
+  name, ok := clientProjects[cn]
+  if !ok {
+    return nil
+  }
+  p, err := gotcha.LoadProject(name)
+  if err != nil {
+    return nil
+  }
+  return &gotcha.Token{Name: "certificate " + cn, ProjectID: p.ID, Scopes: []string{gotcha.ScopeAdmin}}
+}
@@ -3,7 +3,8 @@
 def send(title, url)
   puts title
   puts url
-  puts `curl -X #{url} -s -i`
+  auth = ENV['GOTCHA_TOKEN'] ? "-H 'Authorization: Bearer #{ENV['GOTCHA_TOKEN']}'" : ""
+  puts `curl -X #{url} #{auth} -s -i`
 end
 
 send "* Creating project", "POST http://localhost:8000/projects/myproject"